@@ -0,0 +1,83 @@
+package collyredis
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Operations reported to an AuditLog.
+const (
+	AuditVisited = "visited"
+	AuditUnvisit = "unvisit"
+	AuditEnqueue = "enqueue"
+	AuditCookie  = "cookie"
+	AuditClear   = "clear"
+	AuditArchive = "archive"
+)
+
+// AuditLog receives a record after each successful mutating operation.
+// Record is called synchronously, so implementations should be fast.
+type AuditLog interface {
+	Record(op, key string, t time.Time)
+}
+
+// RedisAuditLog appends audit records to a redis stream.
+// Each entry has the fields "op", "key" and "time" (unix nanoseconds).
+type RedisAuditLog struct {
+	// Client is used to write the stream, usually the same one as the Storage.
+	Client RedisClient
+
+	// Stream is the key of the redis stream.
+	Stream string
+
+	// Context for the XADD calls, defaults to context.Background().
+	Context context.Context
+
+	// Logger receives the XADD errors, defaults to the standard logger.
+	// Pass the Logger of the Storage to keep its logs in one place.
+	Logger Logger
+}
+
+// NewRedisAuditLog returns a RedisAuditLog writing to the "<prefix>:audit" stream.
+func NewRedisAuditLog(client RedisClient, prefix string) *RedisAuditLog {
+	if prefix == "" {
+		prefix = "colly"
+	}
+	return &RedisAuditLog{
+		Client: client,
+		Stream: prefix + ":audit",
+		Logger: log.Default(),
+	}
+}
+
+// Record implements AuditLog.Record()
+func (a *RedisAuditLog) Record(op, key string, t time.Time) {
+	ctx := a.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	err := a.Client.XAdd(ctx, &redis.XAddArgs{
+		Stream: a.Stream,
+		Values: map[string]interface{}{
+			"op":   op,
+			"key":  key,
+			"time": t.UnixNano(),
+		},
+	}).Err()
+	if err != nil {
+		logger := a.Logger
+		if logger == nil {
+			logger = log.Default()
+		}
+		logger.Printf("Record() .XAdd error %s", err)
+	}
+}
+
+func (s *Storage) audit(op, key string) {
+	if s.AuditLog != nil {
+		s.AuditLog.Record(op, key, time.Now())
+	}
+}
@@ -0,0 +1,21 @@
+package collyredis
+
+import (
+	"bytes"
+	"log"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRedisAuditLogLogger(t *testing.T) {
+	s, m := newTestStorage(t)
+	var buf bytes.Buffer
+	a := NewRedisAuditLog(s.Client, "colly")
+	a.Logger = log.New(&buf, "", 0)
+	m.Close()
+	a.Record(AuditVisited, "colly:request:1", time.Now())
+	if !strings.Contains(buf.String(), "Record() .XAdd error") {
+		t.Fatalf("logged %q, want the XADD error", buf.String())
+	}
+}
@@ -0,0 +1,80 @@
+package collyredis
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// visitedCache is a bounded LRU of request IDs known to be visited.
+type visitedCache struct {
+	mu    sync.Mutex
+	size  int
+	ttl   time.Duration
+	ll    *list.List
+	items map[uint64]*list.Element
+}
+
+type visitedEntry struct {
+	id      uint64
+	expires time.Time
+}
+
+func newVisitedCache(size int, ttl time.Duration) *visitedCache {
+	return &visitedCache{
+		size:  size,
+		ttl:   ttl,
+		ll:    list.New(),
+		items: make(map[uint64]*list.Element, size),
+	}
+}
+
+// get reports whether id is cached and not yet expired.
+func (c *visitedCache) get(id uint64) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.items[id]
+	if !ok {
+		return false
+	}
+	if c.ttl > 0 && time.Now().After(e.Value.(*visitedEntry).expires) {
+		c.ll.Remove(e)
+		delete(c.items, id)
+		return false
+	}
+	c.ll.MoveToFront(e)
+	return true
+}
+
+func (c *visitedCache) add(id uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	expires := time.Now().Add(c.ttl)
+	if e, ok := c.items[id]; ok {
+		e.Value.(*visitedEntry).expires = expires
+		c.ll.MoveToFront(e)
+		return
+	}
+	c.items[id] = c.ll.PushFront(&visitedEntry{id: id, expires: expires})
+	if c.ll.Len() > c.size {
+		e := c.ll.Back()
+		c.ll.Remove(e)
+		delete(c.items, e.Value.(*visitedEntry).id)
+	}
+}
+
+func (c *visitedCache) remove(id uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.items[id]; ok {
+		c.ll.Remove(e)
+		delete(c.items, id)
+	}
+}
+
+func (c *visitedCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ll.Init()
+	c.items = make(map[uint64]*list.Element, c.size)
+}
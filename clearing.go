@@ -0,0 +1,60 @@
+package collyredis
+
+import (
+	"time"
+)
+
+// clearPollInterval is how long the writes of ClearExclusive trust a check
+// of the clearing flag, and how often they poll it while it is set. Clear
+// waits as long after setting the flag, so every writer has seen it.
+const clearPollInterval = 100 * time.Millisecond
+
+// holdClearing sets the clearing flag of ClearExclusive for Clear. The
+// returned function releases it, unless another Clear took it over.
+func (s *Storage) holdClearing() (release func(), err error) {
+	token, err := newToken()
+	if err != nil {
+		return nil, err
+	}
+	key := s.getClearingID()
+	err = s.client().Set(s.Context, key, token, s.ClearFlagTTL).Err()
+	if err != nil {
+		return nil, err
+	}
+	release = func() {
+		err := resignLeaderScript.Run(s.Context, s.client(), []string{key}, token).Err()
+		if err != nil {
+			s.Logger.Printf("Clear() error releasing %s: %s", key, err)
+		}
+	}
+	select {
+	case <-s.Context.Done():
+		release()
+		return nil, s.Context.Err()
+	case <-time.After(clearPollInterval):
+	}
+	return release, nil
+}
+
+// waitClearing blocks a write of ClearExclusive while any process holds the
+// clearing flag. A check finding no flag is trusted for clearPollInterval.
+func (s *Storage) waitClearing() error {
+	if t, ok := s.clearChecked.Load().(time.Time); ok && time.Since(t) < clearPollInterval {
+		return nil
+	}
+	for {
+		n, err := s.client().Exists(s.Context, s.getClearingID()).Result()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			s.clearChecked.Store(time.Now())
+			return nil
+		}
+		select {
+		case <-s.Context.Done():
+			return s.Context.Err()
+		case <-time.After(clearPollInterval):
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package collyredis
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+func TestClearExclusiveAcrossProcesses(t *testing.T) {
+	s, m := newTestStorage(t)
+	s.ClearExclusive = true
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+	client := redis.NewClient(&redis.Options{Addr: m.Addr()})
+	t.Cleanup(func() { client.Close() })
+	other := &Storage{Client: client, ClearExclusive: true}
+	if err := other.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Set(s.getClearingID(), "token"); err != nil {
+		t.Fatal(err)
+	}
+	m.SetTTL(s.getClearingID(), time.Minute)
+	done := make(chan error, 1)
+	go func() { done <- s.AddRequest([]byte("a")) }()
+	select {
+	case err := <-done:
+		t.Fatalf("AddRequest() = %v while another process clears", err)
+	case <-time.After(3 * clearPollInterval):
+	}
+	// the flag expires if the clearing process died
+	m.FastForward(time.Minute)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(3 * clearPollInterval):
+		t.Fatal("AddRequest() still blocked after the flag expired")
+	}
+	if err := other.Clear(); err != nil {
+		t.Fatal(err)
+	}
+	if m.Exists(s.getClearingID()) {
+		t.Fatal("Clear() left the clearing flag")
+	}
+	if n, _ := s.QueueSize(); n != 0 {
+		t.Fatalf("QueueSize() = %d, want 0", n)
+	}
+}
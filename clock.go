@@ -0,0 +1,28 @@
+package collyredis
+
+import (
+	"context"
+	"time"
+)
+
+// ServerTime returns the clock of the redis server. Workers comparing times
+// with each other should use it rather than their own, possibly skewed,
+// clocks; the queue ages and the crawl start of CrawlTTL are taken from it.
+func (s *Storage) ServerTime() (time.Time, error) {
+	var t time.Time
+	err := s.do("ServerTime", func() (err error) {
+		t, err = serverTime(s.Context, s.client())
+		return err
+	})
+	return t, err
+}
+
+// serverTime returns the clock of the server of c.
+func serverTime(ctx context.Context, c RedisClient) (time.Time, error) {
+	return c.Time(ctx).Result()
+}
+
+// unixMilli returns t in milliseconds since the epoch, as stored in redis.
+func unixMilli(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
@@ -0,0 +1,113 @@
+package collyredis
+
+import (
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// readCoalescer batches concurrent IsVisited calls, see CoalesceReads.
+type readCoalescer struct {
+	s        *Storage
+	mu       sync.Mutex
+	pending  []*visitedRead
+	inFlight int
+}
+
+// visitedRead is one IsVisited call waiting for its batch.
+type visitedRead struct {
+	id      uint64
+	done    chan struct{}
+	visited bool
+	err     error
+}
+
+// isVisited checks a single request at once if no other read is running,
+// and else joins the pending batch.
+func (c *readCoalescer) isVisited(id uint64) (bool, error) {
+	c.mu.Lock()
+	if c.inFlight == 0 && len(c.pending) == 0 {
+		c.inFlight++
+		c.mu.Unlock()
+		res := c.flush([]*visitedRead{{id: id}})
+		c.finish()
+		return res[0].visited, res[0].err
+	}
+	r := &visitedRead{id: id, done: make(chan struct{})}
+	c.pending = append(c.pending, r)
+	if len(c.pending) == 1 {
+		time.AfterFunc(c.s.CoalesceWindow, c.flushPending)
+	}
+	c.mu.Unlock()
+	<-r.done
+	return r.visited, r.err
+}
+
+// flushPending sends the pending batch, if any. It runs when the window of
+// the batch ends or when the last read in flight returns.
+func (c *readCoalescer) flushPending() {
+	c.mu.Lock()
+	reads := c.pending
+	c.pending = nil
+	if len(reads) == 0 {
+		c.mu.Unlock()
+		return
+	}
+	c.inFlight++
+	c.mu.Unlock()
+	for _, r := range c.flush(reads) {
+		close(r.done)
+	}
+	c.finish()
+}
+
+// finish marks a read returned, and sends the pending batch without
+// waiting for its window if it was the last one in flight.
+func (c *readCoalescer) finish() {
+	c.mu.Lock()
+	c.inFlight--
+	next := c.inFlight == 0 && len(c.pending) > 0
+	c.mu.Unlock()
+	if next {
+		go c.flushPending()
+	}
+}
+
+// flush resolves the reads with one pipeline. The key types are read
+// instead of their existence, so a key holding another type fails its read
+// with an ErrWrongKeyType like the single IsVisited does.
+func (c *readCoalescer) flush(reads []*visitedRead) []*visitedRead {
+	s := c.s
+	err := s.do("IsVisited", func() error {
+		pipe := s.visitedClient().Pipeline()
+		cmds := make([]*redis.StatusCmd, len(reads))
+		for i, r := range reads {
+			key := s.getIDStr(r.id)
+			cmds[i] = pipe.Type(s.Context, key)
+			if s.refreshNow() {
+				pipe.Expire(s.Context, key, s.Expires)
+			}
+		}
+		_, err := pipe.Exec(s.Context)
+		if err != nil {
+			return err
+		}
+		for i, r := range reads {
+			switch typ := cmds[i].Val(); typ {
+			case "none":
+			case "string":
+				r.visited = true
+			default:
+				r.err = &ErrWrongKeyType{Key: s.getIDStr(r.id), Expected: "string", Actual: typ}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		for _, r := range reads {
+			r.err = err
+		}
+	}
+	return reads
+}
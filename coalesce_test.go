@@ -0,0 +1,50 @@
+package collyredis
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCoalesceReadsSequential(t *testing.T) {
+	s, _ := newTestStorage(t)
+	s.CoalesceReads = true
+	s.CoalesceWindow = time.Second
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	for i := uint64(0); i < 10; i++ {
+		if _, err := s.IsVisited(i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if d := time.Since(start); d > s.CoalesceWindow {
+		t.Fatalf("sequential IsVisited calls took %s, they must not wait for a batch", d)
+	}
+}
+
+func TestCoalesceReadsConcurrent(t *testing.T) {
+	s, _ := newTestStorage(t)
+	s.CoalesceReads = true
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+	for i := uint64(0); i < 50; i += 2 {
+		if err := s.Visited(i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var wg sync.WaitGroup
+	for i := uint64(0); i < 50; i++ {
+		wg.Add(1)
+		go func(id uint64) {
+			defer wg.Done()
+			visited, err := s.IsVisited(id)
+			if err != nil || visited != (id%2 == 0) {
+				t.Errorf("IsVisited(%d) = %v, %v", id, visited, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
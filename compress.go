@@ -0,0 +1,138 @@
+package collyredis
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compressor compresses queued requests.
+//
+// A compressed payload is stored as the Tag byte followed by the output of
+// Compress. On read the first byte is matched against the tags of all known
+// compressors, so a queue holding requests of mixed algorithms still decodes
+// during a migration. Payloads starting with an unknown byte are returned as
+// they are, which covers uncompressed colly requests (they start with '{').
+// Tags 0x01 to 0x1f are reserved for the built-in compressors.
+type Compressor interface {
+	Tag() byte
+	Compress(b []byte) ([]byte, error)
+	Decompress(b []byte) ([]byte, error)
+}
+
+// GzipCompressor is a Compressor using gzip, a safe default.
+type GzipCompressor struct {
+	// Level is a compress/gzip level, zero means gzip.DefaultCompression.
+	Level int
+}
+
+// Tag implements Compressor.Tag()
+func (GzipCompressor) Tag() byte {
+	return 0x01
+}
+
+// Compress implements Compressor.Compress()
+func (c GzipCompressor) Compress(b []byte) ([]byte, error) {
+	level := c.Level
+	if level == 0 {
+		level = gzip.DefaultCompression
+	}
+	var buf bytes.Buffer
+	w, err := gzip.NewWriterLevel(&buf, level)
+	if err != nil {
+		return nil, err
+	}
+	_, err = w.Write(b)
+	if err != nil {
+		return nil, err
+	}
+	err = w.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Decompress implements Compressor.Decompress()
+func (GzipCompressor) Decompress(b []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+// ZstdCompressor is a Compressor using zstd, for better ratios and speed
+// than gzip. The zero value is ready to use and safe for concurrent use.
+type ZstdCompressor struct {
+	once sync.Once
+	enc  *zstd.Encoder
+	dec  *zstd.Decoder
+	err  error
+}
+
+func (c *ZstdCompressor) init() error {
+	c.once.Do(func() {
+		c.enc, c.err = zstd.NewWriter(nil)
+		if c.err != nil {
+			return
+		}
+		c.dec, c.err = zstd.NewReader(nil)
+	})
+	return c.err
+}
+
+// Tag implements Compressor.Tag()
+func (*ZstdCompressor) Tag() byte {
+	return 0x02
+}
+
+// Compress implements Compressor.Compress()
+func (c *ZstdCompressor) Compress(b []byte) ([]byte, error) {
+	if err := c.init(); err != nil {
+		return nil, err
+	}
+	return c.enc.EncodeAll(b, nil), nil
+}
+
+// Decompress implements Compressor.Decompress()
+func (c *ZstdCompressor) Decompress(b []byte) ([]byte, error) {
+	if err := c.init(); err != nil {
+		return nil, err
+	}
+	return c.dec.DecodeAll(b, nil)
+}
+
+// encodeRequest converts a request to its stored form.
+func (s *Storage) encodeRequest(r []byte) ([]byte, error) {
+	if s.Compressor == nil {
+		return r, nil
+	}
+	b, err := s.Compressor.Compress(r)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{s.Compressor.Tag()}, b...), nil
+}
+
+// decodeRequest strips the priority header of a stored request, detects
+// its compressor and decodes it.
+func (s *Storage) decodeRequest(v []byte) ([]byte, error) {
+	_, v = s.splitPriority(v)
+	if len(v) == 0 {
+		return v, nil
+	}
+	if c := s.Compressor; c != nil && v[0] == c.Tag() {
+		return c.Decompress(v[1:])
+	}
+	for _, c := range s.Decompressors {
+		if v[0] == c.Tag() {
+			return c.Decompress(v[1:])
+		}
+	}
+	return v, nil
+}
@@ -0,0 +1,94 @@
+package collyredis
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+// collyRequest is a JSON-encoded request as colly.Request.Marshal queues it.
+func collyRequest(tb testing.TB) []byte {
+	b, err := json.Marshal(struct {
+		URL     string
+		Method  string
+		Depth   int
+		Body    []byte
+		ID      uint32
+		Ctx     map[string]interface{}
+		Headers http.Header
+	}{
+		URL:    "https://www.example.com/catalog/products/12345?utm_source=newsletter&page=2",
+		Method: "GET",
+		Depth:  3,
+		ID:     42,
+		Ctx:    map[string]interface{}{"category": "shoes", "referer": "https://www.example.com/catalog"},
+		Headers: http.Header{
+			"Accept":          {"text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8"},
+			"Accept-Language": {"en-US,en;q=0.5"},
+			"User-Agent":      {"colly - https://github.com/gocolly/colly/v2"},
+		},
+	})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return b
+}
+
+func benchmarkCompressor(b *testing.B, c Compressor) {
+	r := collyRequest(b)
+	v, err := c.Compress(r)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportMetric(float64(len(v))/float64(len(r)), "ratio")
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		v, err := c.Compress(r)
+		if err != nil {
+			b.Fatal(err)
+		}
+		_, err = c.Decompress(v)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkGzipCompressor(b *testing.B) {
+	benchmarkCompressor(b, GzipCompressor{})
+}
+
+func BenchmarkZstdCompressor(b *testing.B) {
+	benchmarkCompressor(b, &ZstdCompressor{})
+}
+
+func TestDecompressorsMixedQueue(t *testing.T) {
+	s, _ := newTestStorage(t)
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+	r := collyRequest(t)
+	want := []string{"plain", "gzip", "zstd"}
+	for _, name := range want {
+		switch name {
+		case "gzip":
+			s.Compressor = GzipCompressor{}
+		case "zstd":
+			s.Compressor = &ZstdCompressor{}
+			s.Decompressors = []Compressor{GzipCompressor{}}
+		}
+		if err := s.AddRequest(append([]byte(name), r...)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range want {
+		got, err := s.GetRequest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != name+string(r) {
+			t.Fatalf("GetRequest() = %q, want the %s request", got, name)
+		}
+	}
+}
@@ -0,0 +1,258 @@
+package collyredis
+
+import (
+	"encoding/json"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// NoExpiration is returned by CookieTTL for cookies which never expire.
+const NoExpiration time.Duration = -1
+
+// copyCookiesScript copies the stored cookies of one host to another and,
+// when flagged, deletes the source. It returns 0 if the source has none.
+// A positive ARGV[2] is the expiration of the copy in milliseconds.
+var copyCookiesScript = redis.NewScript(`
+local v = redis.call('GET', KEYS[1])
+if not v then
+	return 0
+end
+if tonumber(ARGV[2]) > 0 then
+	redis.call('SET', KEYS[2], v, 'PX', ARGV[2])
+else
+	redis.call('SET', KEYS[2], v)
+end
+if ARGV[1] == '1' then
+	redis.call('DEL', KEYS[1])
+end
+return 1
+`)
+
+// CookieFormat is a tagged encoding for stored cookie values.
+//
+// A value written with a format is stored as Magic() followed by the output
+// of Encode. On read the stored value is matched against the magic prefix of
+// every known format, and the rest is handed to the matching Decode. Values
+// that match no magic prefix are legacy raw cookie strings and are returned
+// as they are, so old and new writers can share a keyspace during a rollout.
+//
+// Magic prefixes should start with a byte that cannot begin a cookie string,
+// e.g. "\x00", and no magic may be a prefix of another one.
+type CookieFormat interface {
+	Magic() string
+	Encode(cookies string) (string, error)
+	Decode(value string) (string, error)
+}
+
+// JSONCookieFormat stores cookies as a JSON array with one cookie per element.
+// Its magic prefix is "\x00json:".
+type JSONCookieFormat struct{}
+
+// Magic implements CookieFormat.Magic()
+func (JSONCookieFormat) Magic() string {
+	return "\x00json:"
+}
+
+// Encode implements CookieFormat.Encode()
+func (JSONCookieFormat) Encode(cookies string) (string, error) {
+	lines := []string{}
+	if cookies != "" {
+		lines = strings.Split(cookies, "\n")
+	}
+	b, err := json.Marshal(lines)
+	return string(b), err
+}
+
+// Decode implements CookieFormat.Decode()
+func (JSONCookieFormat) Decode(value string) (string, error) {
+	var lines []string
+	err := json.Unmarshal([]byte(value), &lines)
+	if err != nil {
+		return "", err
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+// CopyCookies atomically copies the cookies of from's host to to's host,
+// e.g. to carry a session over when a site moves to another domain.
+// The stored value is copied as it is, so its format is kept.
+// It is a no-op if from's host has no cookies, or if both hosts share a key,
+// e.g. the same host or two merged by the HostNormalizer.
+func (s *Storage) CopyCookies(from, to *url.URL) error {
+	return s.copyCookies("CopyCookies", from, to, false)
+}
+
+// MoveCookies works like CopyCookies, but also deletes the cookies of from's host.
+func (s *Storage) MoveCookies(from, to *url.URL) error {
+	return s.copyCookies("MoveCookies", from, to, true)
+}
+
+func (s *Storage) copyCookies(op string, from, to *url.URL, move bool) error {
+	fromKey, key := s.getCookieID(from.Host), s.getCookieID(to.Host)
+	if fromKey == key {
+		// moving would delete the copy
+		return nil
+	}
+	defer s.cookieLocks.lock(fromKey, key)()
+	var n int64
+	err := s.doWrite(op, func() (err error) {
+		n, err = copyCookiesScript.Run(s.Context, s.cookieClient(),
+			[]string{fromKey, key}, flag(move), s.CookieExpires.Milliseconds()).Int64()
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		s.audit(AuditCookie, key)
+	}
+	return nil
+}
+
+// CookieTTL returns the remaining time to live of the cookies of u's host,
+// e.g. to check that CookieExpires is applied or to find sessions about to
+// expire. It returns NoExpiration if they never expire, and redis.Nil if the
+// host has no cookies. TTL works on any type, so the key type is read in the
+// same pipeline to report an ErrWrongKeyType.
+func (s *Storage) CookieTTL(u *url.URL) (time.Duration, error) {
+	var ttl time.Duration
+	key := s.getCookieID(u.Host)
+	err := s.do("CookieTTL", func() error {
+		pipe := s.cookieClient().Pipeline()
+		typ := pipe.Type(s.Context, key)
+		cmd := pipe.TTL(s.Context, key)
+		_, err := pipe.Exec(s.Context)
+		if err != nil {
+			return err
+		}
+		if t := typ.Val(); t != "none" && t != "string" {
+			return &ErrWrongKeyType{Key: key, Expected: "string", Actual: t}
+		}
+		ttl = cmd.Val()
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	if ttl == -2 {
+		return 0, redis.Nil
+	}
+	return ttl, nil
+}
+
+// ExportCookies returns the decoded cookies of every host, e.g. for a
+// backup of the sessions independent of the queue and visited data.
+// Keys are scanned and read with one pipeline per page.
+func (s *Storage) ExportCookies() (map[string]string, error) {
+	defer s.cookieLocks.rlock()()
+	m := make(map[string]string)
+	err := s.do("ExportCookies", func() error {
+		c := s.cookieClient()
+		prefix := s.getCookiePrefix()
+		var cursor uint64
+		for {
+			keys, next, err := c.Scan(s.Context, cursor, prefix+"*", pageSize).Result()
+			if err != nil {
+				return err
+			}
+			if len(keys) > 0 {
+				pipe := c.Pipeline()
+				cmds := make([]*redis.StringCmd, len(keys))
+				for i, key := range keys {
+					cmds[i] = pipe.Get(s.Context, key)
+				}
+				_, err = pipe.Exec(s.Context)
+				if err != nil && err != redis.Nil {
+					return err
+				}
+				for i, key := range keys {
+					v, err := cmds[i].Result()
+					if err == redis.Nil {
+						// removed while scanning
+						continue
+					}
+					v, err = s.decodeCookies(v)
+					if err != nil {
+						return err
+					}
+					m[strings.TrimPrefix(key, prefix)] = v
+				}
+			}
+			if next == 0 {
+				return nil
+			}
+			cursor = next
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// ImportCookies stores the cookies of every host, e.g. from ExportCookies.
+// Existing cookies of those hosts are overwritten. With a HostNormalizer,
+// which of several hosts normalizing to the same one wins is undefined.
+func (s *Storage) ImportCookies(m map[string]string) error {
+	defer s.cookieLocks.lock()()
+	values := make(map[string]string, len(m))
+	for host, cookies := range m {
+		v, err := s.encodeCookies(cookies)
+		if err != nil {
+			return err
+		}
+		values[s.getCookieID(host)] = v
+	}
+	err := s.doWrite("ImportCookies", func() error {
+		pipe := s.cookieClient().Pipeline()
+		n := 0
+		for key, v := range values {
+			pipe.Set(s.Context, key, v, s.CookieExpires)
+			n++
+			if n%pageSize == 0 {
+				_, err := pipe.Exec(s.Context)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		_, err := pipe.Exec(s.Context)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	for key := range values {
+		s.debugTTL("ImportCookies", key, s.CookieExpires)
+		s.audit(AuditCookie, key)
+	}
+	return nil
+}
+
+// encodeCookies converts cookies to their stored form.
+func (s *Storage) encodeCookies(cookies string) (string, error) {
+	if s.CookieFormat == nil {
+		return cookies, nil
+	}
+	v, err := s.CookieFormat.Encode(cookies)
+	if err != nil {
+		return "", err
+	}
+	return s.CookieFormat.Magic() + v, nil
+}
+
+// decodeCookies detects the format of a stored value and decodes it.
+func (s *Storage) decodeCookies(value string) (string, error) {
+	if f := s.CookieFormat; f != nil && strings.HasPrefix(value, f.Magic()) {
+		return f.Decode(value[len(f.Magic()):])
+	}
+	for _, f := range s.CookieFormats {
+		if strings.HasPrefix(value, f.Magic()) {
+			return f.Decode(value[len(f.Magic()):])
+		}
+	}
+	return value, nil
+}
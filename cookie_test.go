@@ -0,0 +1,26 @@
+package collyredis
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestMoveCookiesSameKey(t *testing.T) {
+	s, _ := newTestStorage(t)
+	s.HostNormalizer = func(host string) string { return strings.TrimPrefix(host, "www.") }
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+	from := &url.URL{Host: "www.example.com"}
+	to := &url.URL{Host: "example.com"}
+	s.SetCookies(from, "a=1")
+	for _, u := range []*url.URL{from, to} {
+		if err := s.MoveCookies(from, u); err != nil {
+			t.Fatal(err)
+		}
+		if got := s.Cookies(to); got != "a=1" {
+			t.Fatalf("Cookies() after a move to %s = %q, want \"a=1\"", u.Host, got)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package collyredis
+
+import (
+	"hash/fnv"
+	"sort"
+	"sync"
+)
+
+// cookieLocks stripes the cookie locks by key, so cookies of different hosts
+// do not contend while writes of one host are still serialized.
+type cookieLocks []sync.RWMutex
+
+// stripes returns the sorted, distinct stripes of keys, or all of them
+// without keys. Locking in this order cannot deadlock.
+func (l cookieLocks) stripes(keys []string) []int {
+	if len(keys) == 0 {
+		all := make([]int, len(l))
+		for i := range all {
+			all[i] = i
+		}
+		return all
+	}
+	var idx []int
+	for _, key := range keys {
+		h := fnv.New32a()
+		_, _ = h.Write([]byte(key))
+		i := int(h.Sum32() % uint32(len(l)))
+		found := false
+		for _, j := range idx {
+			found = found || i == j
+		}
+		if !found {
+			idx = append(idx, i)
+		}
+	}
+	sort.Ints(idx)
+	return idx
+}
+
+// lock write-locks the stripes of keys, or all stripes without keys,
+// and returns the unlock function.
+func (l cookieLocks) lock(keys ...string) func() {
+	idx := l.stripes(keys)
+	for _, i := range idx {
+		l[i].Lock()
+	}
+	return func() {
+		for _, i := range idx {
+			l[i].Unlock()
+		}
+	}
+}
+
+// rlock read-locks like lock.
+func (l cookieLocks) rlock(keys ...string) func() {
+	idx := l.stripes(keys)
+	for _, i := range idx {
+		l[i].RLock()
+	}
+	return func() {
+		for _, i := range idx {
+			l[i].RUnlock()
+		}
+	}
+}
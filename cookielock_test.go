@@ -0,0 +1,56 @@
+package collyredis
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// slowClient adds a network round trip to SET, which a local miniredis
+// lacks, so the benchmark measures the time writes wait for their lock.
+type slowClient struct {
+	*redis.Client
+	rtt time.Duration
+}
+
+func (c slowClient) Set(ctx context.Context, key string, value interface{}, expiration time.Duration) *redis.StatusCmd {
+	time.Sleep(c.rtt)
+	return c.Client.Set(ctx, key, value, expiration)
+}
+
+// BenchmarkSetCookiesParallel writes the cookies of many hosts concurrently,
+// with a single lock as before stripes and with the default stripes.
+func BenchmarkSetCookiesParallel(b *testing.B) {
+	hosts := make([]*url.URL, 256)
+	for i := range hosts {
+		hosts[i] = &url.URL{Host: fmt.Sprintf("host%d.example.com", i)}
+	}
+	for _, stripes := range []int{1, 0} {
+		name := fmt.Sprintf("stripes=%d", stripes)
+		if stripes == 0 {
+			name = "stripes=default"
+		}
+		b.Run(name, func(b *testing.B) {
+			s, _ := newTestStorage(b)
+			s.Client = slowClient{s.Client.(*redis.Client), 200 * time.Microsecond}
+			s.CookieLockStripes = stripes
+			if err := s.Init(); err != nil {
+				b.Fatal(err)
+			}
+			var n uint32
+			b.SetParallelism(8)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					u := hosts[atomic.AddUint32(&n, 1)%uint32(len(hosts))]
+					s.SetCookies(u, "session=abc; lang=en")
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,178 @@
+package collyredis
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// startCrawl records the crawl start time, unless a previous Init did.
+func (s *Storage) startCrawl() error {
+	now, err := serverTime(s.Context, s.client())
+	if err != nil {
+		return err
+	}
+	return s.client().SetNX(s.Context, s.getCrawlStartID(), unixMilli(now), 0).Err()
+}
+
+// CrawlRemaining returns how long the crawl has left before it is cleared
+// because of CrawlTTL. It is zero or negative once the lifetime is over.
+func (s *Storage) CrawlRemaining() (time.Duration, error) {
+	var d time.Duration
+	err := s.do("CrawlRemaining", func() (err error) {
+		d, err = s.crawlRemaining()
+		return err
+	})
+	return d, err
+}
+
+func (s *Storage) crawlRemaining() (time.Duration, error) {
+	ms, err := s.client().Get(s.Context, s.getCrawlStartID()).Int64()
+	if err == redis.Nil {
+		// cleared, checkCrawlTTL records a new start
+		return s.CrawlTTL, nil
+	} else if err != nil {
+		return 0, err
+	}
+	now, err := serverTime(s.Context, s.client())
+	if err != nil {
+		return 0, err
+	}
+	start := time.Unix(0, ms*int64(time.Millisecond))
+	return start.Add(s.CrawlTTL).Sub(now), nil
+}
+
+// IncrProgress increments the "pages crawled" counter and returns the new
+// value. Call it after every successfully processed page. The counter is a
+// cheap progress readout, unrelated to the visited state and VisitedCount:
+// it counts what the crawler reports, not what was deduplicated.
+func (s *Storage) IncrProgress() (int64, error) {
+	var n int64
+	err := s.doWrite("IncrProgress", func() (err error) {
+		n, err = s.client().Incr(s.Context, s.getProgressID()).Result()
+		return err
+	})
+	return n, err
+}
+
+// Progress returns the "pages crawled" counter, see IncrProgress.
+func (s *Storage) Progress() (int64, error) {
+	var n int64
+	err := s.do("Progress", func() (err error) {
+		n, err = s.client().Get(s.Context, s.getProgressID()).Int64()
+		if err == redis.Nil {
+			return nil
+		}
+		return err
+	})
+	return n, err
+}
+
+// ArchiveCrawl moves every key of the crawl under archivePrefix, renaming
+// "<prefix>:..." to "<archivePrefix>:<prefix>:...", so a completed crawl is
+// kept for later analysis while the prefix is free for reuse. RENAME keeps
+// the TTLs and overwrites existing keys of the same name in the archive.
+//
+// Keys are scanned and renamed in batches of one pipeline per page, so the
+// archive is not atomic: if it fails or the process crashes half way, the
+// remaining keys stay under the prefix and calling ArchiveCrawl again moves
+// them too. Keys in different slots cannot be renamed on redis cluster.
+// Keys of other crawls under a longer prefix, e.g. "<prefix>:shop", are
+// left alone.
+func (s *Storage) ArchiveCrawl(archivePrefix string) error {
+	if archivePrefix == "" || strings.HasPrefix(archivePrefix+":", s.Prefix+":") {
+		return fmt.Errorf("invalid archive prefix %q", archivePrefix)
+	}
+	err := s.doWrite("ArchiveCrawl", func() error {
+		for _, c := range s.clients() {
+			err := s.archiveKeys(c, archivePrefix)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if s.visitedCache != nil {
+		s.visitedCache.clear()
+	}
+	s.audit(AuditArchive, archivePrefix)
+	return nil
+}
+
+func (s *Storage) archiveKeys(c RedisClient, archivePrefix string) error {
+	var cursor uint64
+	for {
+		keys, next, err := c.Scan(s.Context, cursor, s.Prefix+":*", pageSize).Result()
+		if err != nil {
+			return err
+		}
+		var cmds []*redis.StatusCmd
+		pipe := c.Pipeline()
+		for _, key := range keys {
+			if s.ownsKey(key) {
+				cmds = append(cmds, pipe.Rename(s.Context, key, archivePrefix+":"+key))
+			}
+		}
+		if len(cmds) > 0 {
+			_, _ = pipe.Exec(s.Context)
+			for _, cmd := range cmds {
+				err := cmd.Err()
+				// the key expired or was removed since the scan
+				if err != nil && !strings.Contains(err.Error(), "no such key") {
+					return err
+				}
+			}
+		}
+		if next == 0 {
+			return nil
+		}
+		cursor = next
+	}
+}
+
+// runCrawlTTL clears the storage once CrawlTTL is over, until Close.
+func (s *Storage) runCrawlTTL() {
+	for {
+		wait, cleared := s.checkCrawlTTL()
+		if cleared {
+			return
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-s.done:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// checkCrawlTTL clears the storage if CrawlTTL is over and reports whether
+// it did, or returns how long to wait for the next check. A start deleted
+// by another Clear is recorded again first, so the new crawl expires too.
+func (s *Storage) checkCrawlTTL() (wait time.Duration, cleared bool) {
+	wait = time.Minute
+	err := s.doWrite("StartCrawl", s.startCrawl)
+	if err != nil {
+		s.Logger.Printf("startCrawl() error %s", err)
+	}
+	remaining, err := s.CrawlRemaining()
+	if err != nil {
+		s.Logger.Printf("CrawlRemaining() error %s", err)
+	} else if remaining <= 0 {
+		err = s.Clear()
+		if err == nil {
+			s.Logger.Printf("crawl %s is cleared after %s", s.Prefix, s.CrawlTTL)
+			return 0, true
+		}
+		s.Logger.Printf("Clear() error %s", err)
+	} else if remaining < wait {
+		wait = remaining
+	}
+	return wait, false
+}
@@ -0,0 +1,55 @@
+package collyredis
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCrawlTTLRestartsAfterClear(t *testing.T) {
+	s, m := newTestStorage(t)
+	s.CrawlTTL = time.Hour
+	start := time.Date(2021, 5, 1, 12, 0, 0, 0, time.UTC)
+	m.SetTime(start)
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if err := s.Clear(); err != nil {
+		t.Fatal(err)
+	}
+	if _, cleared := s.checkCrawlTTL(); cleared {
+		t.Fatal("checkCrawlTTL() cleared a new crawl")
+	}
+	m.SetTime(start.Add(30 * time.Minute))
+	remaining, err := s.CrawlRemaining()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if remaining != 30*time.Minute {
+		t.Fatalf("CrawlRemaining() = %s, want 30m0s", remaining)
+	}
+}
+
+func TestArchiveCrawlSkipsLongerPrefix(t *testing.T) {
+	s, m := newTestStorage(t)
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddRequest([]byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Set("colly:shop:progress", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.ArchiveCrawl("archive"); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"archive:colly:queue", "colly:shop:progress"} {
+		if !m.Exists(key) {
+			t.Errorf("%s is missing after ArchiveCrawl", key)
+		}
+	}
+	if m.Exists("archive:colly:shop:progress") {
+		t.Error("ArchiveCrawl moved a key of a longer prefix")
+	}
+}
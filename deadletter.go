@@ -0,0 +1,98 @@
+package collyredis
+
+import (
+	"strconv"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// failRequestScript counts a failed attempt of the request ARGV[1] in the
+// hash KEYS[1]. Once it reaches ARGV[3] (if positive) the payload ARGV[2] is
+// pushed to the dead-letter list KEYS[3] and its count deleted, otherwise it
+// is pushed back to the queue KEYS[2] like pushRequestScript does, with the
+// debug summary ARGV[4] to KEYS[4] and the enqueue time ARGV[5] to KEYS[5].
+// It returns 1 if dead-lettered.
+var failRequestScript = redis.NewScript(`
+local n = redis.call('HINCRBY', KEYS[1], ARGV[1], 1)
+local max = tonumber(ARGV[3])
+if max > 0 and n >= max then
+	redis.call('HDEL', KEYS[1], ARGV[1])
+	redis.call('LPUSH', KEYS[3], ARGV[2])
+	return 1
+end
+if ARGV[4] ~= '' then
+	redis.call('LPUSH', KEYS[4], ARGV[4])
+end
+if ARGV[5] ~= '' then
+	redis.call('ZADD', KEYS[5], ARGV[5], ARGV[2])
+end
+redis.call('LPUSH', KEYS[2], ARGV[2])
+return 0
+`)
+
+// drainDeadLetterScript returns the whole list KEYS[1] and deletes it.
+var drainDeadLetterScript = redis.NewScript(`
+local v = redis.call('LRANGE', KEYS[1], 0, -1)
+redis.call('DEL', KEYS[1])
+return v
+`)
+
+// FailRequest records a failed processing attempt of the request r, whose
+// colly ID is requestID, and requeues it. Every call counts one attempt;
+// when MaxProcessAttempts attempts have failed, r is moved to the
+// "<prefix>:deadletter" list instead and its count reset, and deadLettered
+// is true. Without MaxProcessAttempts requests are always requeued. The
+// requeue updates the DebugQueue mirror and the queue ages like AddRequest.
+func (s *Storage) FailRequest(requestID uint64, r []byte) (deadLettered bool, err error) {
+	v, err := s.encodeRequest(r)
+	if err != nil {
+		return false, err
+	}
+	var n int64
+	err = s.doWrite("FailRequest", func() (err error) {
+		summary, score, err := s.mirrorArgs(r)
+		if err != nil {
+			return err
+		}
+		n, err = failRequestScript.Run(s.Context, s.queueClient(),
+			[]string{s.getAttemptsID(), s.getQueueID(), s.getDeadLetterID(), s.getQueueDebugID(), s.getQueueAgesID()},
+			strconv.FormatUint(requestID, 10), v, s.MaxProcessAttempts, summary, score).Int64()
+		return err
+	})
+	if err != nil {
+		return false, err
+	}
+	if n == 1 {
+		return true, nil
+	}
+	s.audit(AuditEnqueue, s.getQueueID())
+	return false, nil
+}
+
+// DrainDeadLetter takes every dead-lettered request, oldest first, and empties
+// the dead-letter list in one script, so requests dead-lettered meanwhile are
+// neither lost nor returned twice. Entries which cannot be decoded, e.g.
+// from DeadLetterUnmarshalError, are returned as stored. The whole list is
+// held in memory, both by redis for the reply and here; for very large lists
+// pop "<prefix>:deadletter" from its tail in pages instead.
+func (s *Storage) DrainDeadLetter() ([][]byte, error) {
+	var res interface{}
+	err := s.doWrite("DrainDeadLetter", func() (err error) {
+		res, err = drainDeadLetterScript.Run(s.Context, s.queueClient(), []string{s.getDeadLetterID()}).Result()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	items := res.([]interface{})
+	reqs := make([][]byte, 0, len(items))
+	for i := len(items) - 1; i >= 0; i-- {
+		v := []byte(items[i].(string))
+		r, err := s.decodeRequest(v)
+		if err != nil {
+			r = v
+		}
+		reqs = append(reqs, r)
+	}
+	return reqs, nil
+}
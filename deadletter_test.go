@@ -0,0 +1,47 @@
+package collyredis
+
+import (
+	"testing"
+	"time"
+)
+
+type recordingAuditLog struct {
+	ops []string
+}
+
+func (a *recordingAuditLog) Record(op, key string, t time.Time) {
+	a.ops = append(a.ops, op)
+}
+
+func TestFailRequest(t *testing.T) {
+	s, m := newTestStorage(t)
+	audit := &recordingAuditLog{}
+	s.AuditLog = audit
+	s.MaxProcessAttempts = 2
+	s.DebugQueue = true
+	s.TrackQueueAge = true
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+	r := []byte(`{"URL":"http://example.com/a"}`)
+	dead, err := s.FailRequest(1, r)
+	if err != nil || dead {
+		t.Fatalf("first FailRequest() = %v, %v, want a requeue", dead, err)
+	}
+	if ages, _ := m.ZMembers(s.getQueueAgesID()); len(ages) != 1 {
+		t.Fatalf("%d queue ages after a requeue, want 1", len(ages))
+	}
+	if debug, _ := m.List(s.getQueueDebugID()); len(debug) != 1 {
+		t.Fatalf("%d debug entries after a requeue, want 1", len(debug))
+	}
+	if _, err := s.GetRequest(); err != nil {
+		t.Fatal(err)
+	}
+	dead, err = s.FailRequest(1, r)
+	if err != nil || !dead {
+		t.Fatalf("second FailRequest() = %v, %v, want a dead letter", dead, err)
+	}
+	if len(audit.ops) != 1 || audit.ops[0] != AuditEnqueue {
+		t.Fatalf("audited %q, want a single enqueue", audit.ops)
+	}
+}
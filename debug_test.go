@@ -0,0 +1,76 @@
+package collyredis
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// checkMirror fails unless the DebugQueue mirror is as long as the queue,
+// and with exact holds the summary of every request at its index.
+func checkMirror(t *testing.T, s *Storage, step string, exact bool) {
+	t.Helper()
+	queue, err := s.Client.LRange(s.Context, s.getQueueID(), 0, -1).Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mirror, err := s.Client.LRange(s.Context, s.getQueueDebugID(), 0, -1).Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mirror) != len(queue) {
+		t.Fatalf("after %s the mirror has %d entries, the queue %d", step, len(mirror), len(queue))
+	}
+	if !exact {
+		return
+	}
+	for i, v := range queue {
+		if want := summarizeRequest([]byte(v)); mirror[i] != want {
+			t.Fatalf("after %s mirror[%d] = %s, want %s", step, i, mirror[i], want)
+		}
+	}
+}
+
+func TestDebugQueueMirror(t *testing.T) {
+	s, _ := newTestStorage(t)
+	s.DebugQueue = true
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+	req := func(host string) []byte {
+		return []byte(fmt.Sprintf(`{"URL":"http://%s/","Method":"GET"}`, host))
+	}
+	for _, host := range []string{"a.com", "b.com", "c.com", "d.com"} {
+		if err := s.AddRequest(req(host)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkMirror(t, s, "AddRequest", true)
+	steps := []struct {
+		name  string
+		exact bool
+		run   func() error
+	}{
+		{"RotateQueue", true, func() error { return s.RotateQueue(2) }},
+		{"GetRequestIsLast", true, func() error { _, _, err := s.GetRequestIsLast(); return err }},
+		{"GetRequestInFlight", true, func() error { _, err := s.GetRequestInFlight("w1"); return err }},
+		{"ReleaseWorker", true, func() error { _, err := s.ReleaseWorker("w1"); return err }},
+		{"FailRequest", true, func() error { _, err := s.FailRequest(1, req("e.com")); return err }},
+		{"QuarantineHost", false, func() error { _, err := s.QuarantineHost("b.com"); return err }},
+		{"ReleaseHost", false, func() error { _, err := s.ReleaseHost("b.com"); return err }},
+		{"RemoveRequest", false, func() error { _, err := s.RemoveRequest(req("d.com")); return err }},
+		{"CommitPeek", false, func() error {
+			token, _, err := s.PeekAndLock(time.Minute)
+			if err != nil {
+				return err
+			}
+			return s.CommitPeek(token)
+		}},
+	}
+	for _, step := range steps {
+		if err := step.run(); err != nil {
+			t.Fatalf("%s() error %s", step.name, err)
+		}
+		checkMirror(t, s, step.name, step.exact)
+	}
+}
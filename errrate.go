@@ -0,0 +1,74 @@
+package collyredis
+
+import (
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// errorWindowSize is the number of one second buckets kept by errorWindow,
+// which bounds both its memory and the longest window of ErrorRate.
+const errorWindowSize = 600
+
+// errorWindow counts operations and errors per second in a ring of buckets.
+type errorWindow struct {
+	mu      sync.Mutex
+	buckets [errorWindowSize]errorBucket
+}
+
+type errorBucket struct {
+	sec    int64
+	total  int
+	errors int
+}
+
+func (w *errorWindow) record(now time.Time, failed bool) {
+	sec := now.Unix()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	b := &w.buckets[sec%errorWindowSize]
+	if b.sec != sec {
+		*b = errorBucket{sec: sec}
+	}
+	b.total++
+	if failed {
+		b.errors++
+	}
+}
+
+func (w *errorWindow) rate(now time.Time, window time.Duration) float64 {
+	secs := int64(window / time.Second)
+	if secs < 1 {
+		secs = 1
+	}
+	if secs > errorWindowSize {
+		secs = errorWindowSize
+	}
+	from := now.Unix() - secs
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var total, errors int
+	for _, b := range w.buckets {
+		if b.sec > from {
+			total += b.total
+			errors += b.errors
+		}
+	}
+	if total == 0 {
+		return 0
+	}
+	return float64(errors) / float64(total)
+}
+
+// ErrorRate returns the fraction of storage operations that failed within
+// the last window, from 0 to 1. The window has a one second resolution and
+// is capped to ten minutes. A redis.Nil reply, e.g. of an empty queue, is
+// not counted as an error.
+func (s *Storage) ErrorRate(window time.Duration) float64 {
+	return s.errorWindow.rate(time.Now(), window)
+}
+
+func (s *Storage) recordError(err error) {
+	s.errorWindow.record(time.Now(), err != nil && err != redis.Nil)
+}
@@ -0,0 +1,158 @@
+package collyredis
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// failover tracks whether the FallbackClient is in use.
+type failover struct {
+	mu       sync.RWMutex
+	active   bool
+	failures int
+
+	hooked RedisClient // Client with a failoverHook
+	perOp  bool        // observe the operations in do instead
+}
+
+// failoverHook observes the commands run on Client.
+type failoverHook struct {
+	s *Storage
+}
+
+func (h failoverHook) BeforeProcess(ctx context.Context, _ redis.Cmder) (context.Context, error) {
+	return ctx, nil
+}
+
+func (h failoverHook) AfterProcess(_ context.Context, cmd redis.Cmder) error {
+	h.s.observeFailover(cmd.Err())
+	return nil
+}
+
+func (h failoverHook) BeforeProcessPipeline(ctx context.Context, _ []redis.Cmder) (context.Context, error) {
+	return ctx, nil
+}
+
+func (h failoverHook) AfterProcessPipeline(_ context.Context, cmds []redis.Cmder) error {
+	var err error
+	for _, cmd := range cmds {
+		if isConnError(cmd.Err()) {
+			err = cmd.Err()
+			break
+		}
+	}
+	h.s.observeFailover(err)
+	return nil
+}
+
+// watchPrimary sets up the observation of Client for the failover, so only
+// errors of commands run on it are counted.
+func (s *Storage) watchPrimary() {
+	s.failover.perOp = false
+	if s.FallbackClient == nil {
+		return
+	}
+	if s.failover.hooked == s.Client {
+		return
+	}
+	if c, ok := s.Client.(interface{ AddHook(redis.Hook) }); ok {
+		c.AddHook(failoverHook{s})
+		s.failover.hooked = s.Client
+		return
+	}
+	if len(s.clients()) > 1 {
+		s.Logger.Printf("Client has no AddHook, failover is disabled with keyspace clients")
+		return
+	}
+	s.failover.perOp = true
+}
+
+// client returns the default client, which is FallbackClient during a failover.
+func (s *Storage) client() RedisClient {
+	if s.FallbackClient == nil {
+		return s.Client
+	}
+	s.failover.mu.RLock()
+	defer s.failover.mu.RUnlock()
+	if s.failover.active {
+		return s.FallbackClient
+	}
+	return s.Client
+}
+
+// ActiveClient returns the client currently used in place of Client,
+// which is either Client or FallbackClient.
+func (s *Storage) ActiveClient() RedisClient {
+	return s.client()
+}
+
+// observeFailover counts consecutive connection errors of the primary
+// and switches to the fallback once FailoverThreshold is reached.
+func (s *Storage) observeFailover(err error) {
+	if s.FallbackClient == nil {
+		return
+	}
+	s.failover.mu.Lock()
+	defer s.failover.mu.Unlock()
+	if s.failover.active {
+		return
+	}
+	if !isConnError(err) {
+		s.failover.failures = 0
+		return
+	}
+	s.failover.failures++
+	if s.failover.failures < s.FailoverThreshold {
+		return
+	}
+	s.Logger.Printf("redis primary failed %d times, switching to fallback: %s", s.failover.failures, err)
+	s.failover.active = true
+	s.failover.failures = 0
+	go s.probePrimary()
+}
+
+// probePrimary pings Client until it answers again, then switches back.
+func (s *Storage) probePrimary() {
+	ticker := time.NewTicker(s.FailoverProbeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-s.Context.Done():
+			return
+		case <-ticker.C:
+		}
+		if s.Client.Ping(s.Context).Err() != nil {
+			continue
+		}
+		s.failover.mu.Lock()
+		s.failover.active = false
+		s.failover.mu.Unlock()
+		s.Logger.Printf("redis primary is back, switching from fallback")
+		return
+	}
+}
+
+// isConnError reports whether err is a network level error
+// rather than an error reply of redis.
+func isConnError(err error) bool {
+	if err == nil {
+		return false
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	return strings.Contains(err.Error(), "connection pool timeout")
+}
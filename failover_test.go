@@ -0,0 +1,58 @@
+package collyredis
+
+import (
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+)
+
+// newTestClient returns a client on a fresh miniredis.
+func newTestClient(t *testing.T) (*redis.Client, *miniredis.Miniredis) {
+	m, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(m.Close)
+	c := redis.NewClient(&redis.Options{Addr: m.Addr(), MaxRetries: -1})
+	t.Cleanup(func() { c.Close() })
+	return c, m
+}
+
+func TestFailoverOnPrimaryErrors(t *testing.T) {
+	s, m := newTestStorage(t)
+	fallback, _ := newTestClient(t)
+	s.FallbackClient = fallback
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	m.Close()
+	for i := 0; i < s.FailoverThreshold; i++ {
+		s.AddRequest([]byte("x"))
+	}
+	if s.ActiveClient() != fallback {
+		t.Fatal("ActiveClient() is not the fallback after primary errors")
+	}
+}
+
+func TestFailoverIgnoresKeyspaceClients(t *testing.T) {
+	s, _ := newTestStorage(t)
+	fallback, _ := newTestClient(t)
+	queue, qm := newTestClient(t)
+	s.FallbackClient = fallback
+	s.QueueClient = queue
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	qm.Close()
+	for i := 0; i < 2*s.FailoverThreshold; i++ {
+		if err := s.AddRequest([]byte("x")); err == nil {
+			t.Fatal("AddRequest() on a closed queue client succeeded")
+		}
+	}
+	if s.ActiveClient() != s.Client {
+		t.Fatal("queue client errors failed over the healthy primary")
+	}
+}
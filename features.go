@@ -0,0 +1,104 @@
+package collyredis
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MissingFeaturePolicy decides what Init does when an enabled feature needs a
+// newer redis than the server. The features checked and their fallbacks are:
+//
+//	RedisAuditLog (streams, redis 5.0): falls back to logging the records
+//	to Logger.
+//	CountVisited (HyperLogLog, redis 2.8.9): no equivalent, counting is
+//	disabled.
+//
+// The check is skipped if INFO cannot be read or reports no version.
+type MissingFeaturePolicy int
+
+const (
+	// FailOnMissingFeature makes Init return ErrMissingFeature.
+	FailOnMissingFeature MissingFeaturePolicy = iota
+	// FallBackOnMissingFeature silently switches to the supported
+	// equivalent of the feature, or disables it if there is none.
+	FallBackOnMissingFeature
+	// WarnOnMissingFeature logs a warning and disables the feature.
+	WarnOnMissingFeature
+)
+
+// ErrMissingFeature is returned by Init with FailOnMissingFeature.
+var ErrMissingFeature = errors.New("redis server lacks an enabled feature")
+
+// checkFeatures applies OnMissingFeature.
+func (s *Storage) checkFeatures() error {
+	if a, ok := s.AuditLog.(*RedisAuditLog); ok && !s.serverAtLeast(a.Client, 5, 0, 0) {
+		err := s.missingFeature("RedisAuditLog", "5.0.0")
+		if err != nil {
+			return err
+		}
+		if s.OnMissingFeature == FallBackOnMissingFeature {
+			s.AuditLog = loggerAuditLog{s.Logger}
+		} else {
+			s.AuditLog = nil
+		}
+	}
+	if s.CountVisited && !s.serverAtLeast(s.visitedClient(), 2, 8, 9) {
+		err := s.missingFeature("CountVisited", "2.8.9")
+		if err != nil {
+			return err
+		}
+		s.CountVisited = false
+	}
+	return nil
+}
+
+// missingFeature fails or warns about a feature needing redis version.
+func (s *Storage) missingFeature(feature, version string) error {
+	switch s.OnMissingFeature {
+	case FailOnMissingFeature:
+		return fmt.Errorf("%w: %s needs redis %s", ErrMissingFeature, feature, version)
+	case WarnOnMissingFeature:
+		s.Logger.Printf("%s needs redis %s, disabling it", feature, version)
+	}
+	return nil
+}
+
+// serverAtLeast reports whether the server of c has at least the version,
+// or true if its version is unknown.
+func (s *Storage) serverAtLeast(c RedisClient, version ...int) bool {
+	info, err := c.Info(s.Context, "server").Result()
+	if err != nil {
+		return true
+	}
+	v := parseInfo(info)["redis_version"]
+	if v == "" {
+		return true
+	}
+	parts := strings.Split(v, ".")
+	for i, want := range version {
+		if i >= len(parts) {
+			return want == 0
+		}
+		got, err := strconv.Atoi(parts[i])
+		if err != nil {
+			return true
+		}
+		if got != want {
+			return got > want
+		}
+	}
+	return true
+}
+
+// loggerAuditLog is the fallback of RedisAuditLog, writing to a Logger.
+type loggerAuditLog struct {
+	Logger Logger
+}
+
+// Record implements AuditLog.Record()
+func (l loggerAuditLog) Record(op, key string, t time.Time) {
+	l.Logger.Printf("audit %s %s at %s", op, key, t.Format(time.RFC3339Nano))
+}
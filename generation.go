@@ -0,0 +1,156 @@
+package collyredis
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// switchGenerationScript empties the new generation KEYS[1], which may hold
+// requests pushed to it before a Clear, and renames the previous generation
+// KEYS[2] to KEYS[3] to be deleted.
+var switchGenerationScript = redis.NewScript(`
+redis.call('DEL', KEYS[1])
+if redis.call('EXISTS', KEYS[2]) == 1 then
+	redis.call('RENAME', KEYS[2], KEYS[3])
+end
+return 1
+`)
+
+// migrateGenerationScript moves all requests of KEYS[1] to KEYS[2] as the
+// newest ones, keeping their order, and returns how many were moved.
+var migrateGenerationScript = redis.NewScript(`
+local n = 0
+while true do
+	local v = redis.call('RPOP', KEYS[1])
+	if not v then
+		return n
+	end
+	redis.call('LPUSH', KEYS[2], v)
+	n = n + 1
+end
+`)
+
+// NewQueueGeneration switches the queue to a new, empty generation and
+// returns its number, e.g. to reset the frontier of a crawl while keeping the
+// visited state. The generation counter is increased atomically, so
+// concurrent callers get distinct generations. The requests of the previous
+// generation are discarded, and deleted in the background.
+//
+// Workers of this storage use the new generation at once, other workers
+// when they next poll the counter (see GenerationPollInterval). Requests they
+// push to the previous generation in that window are moved to the active one
+// two poll intervals after the switch, or on Close.
+func (s *Storage) NewQueueGeneration() (generation int, err error) {
+	if !s.QueueGenerations {
+		return 0, errors.New("queue generations are not enabled")
+	}
+	var n int64
+	err = s.doWrite("NewQueueGeneration", func() (err error) {
+		n, err = s.queueClient().Incr(s.Context, s.getGenerationID()).Result()
+		if err != nil {
+			return err
+		}
+		return switchGenerationScript.Run(s.Context, s.queueClient(), []string{
+			s.getGenerationQueueID(int(n)), s.getGenerationQueueID(int(n) - 1),
+			s.getDiscardedGenerationID(int(n) - 1),
+		}).Err()
+	})
+	if err != nil {
+		return 0, err
+	}
+	atomic.StoreInt32(&s.generation, int32(n))
+	go s.retireGeneration(int(n) - 1)
+	return int(n), nil
+}
+
+// retireGeneration deletes the discarded requests of generation gen, and
+// later moves the requests pushed to it by lagging workers to the active
+// generation.
+func (s *Storage) retireGeneration(gen int) {
+	err := s.doWrite("DeleteQueueGeneration", func() error {
+		return s.deleteDiscarded(s.getDiscardedGenerationID(gen))
+	})
+	if err != nil {
+		s.Logger.Printf("NewQueueGeneration() delete error %s", err)
+	}
+	timer := time.NewTimer(2 * s.GenerationPollInterval)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-s.done:
+	}
+	var n int64
+	err = s.doWrite("MigrateQueueGeneration", func() (err error) {
+		n, err = migrateGenerationScript.Run(s.Context, s.queueClient(),
+			[]string{s.getGenerationQueueID(gen), s.getQueueID()}).Int64()
+		return err
+	})
+	if err != nil {
+		s.Logger.Printf("NewQueueGeneration() migrate error %s", err)
+	} else if n > 0 {
+		s.Logger.Printf("moved %d requests pushed to queue generation %d to generation %d", n, gen, s.QueueGeneration())
+	}
+}
+
+// deleteDiscarded deletes the discarded list key, and with TrackQueueAge first
+// its requests from the queue ages, one page at a time.
+func (s *Storage) deleteDiscarded(key string) error {
+	for s.TrackQueueAge {
+		items, err := s.queueClient().LRange(s.Context, key, 0, pageSize-1).Result()
+		if err != nil {
+			return err
+		}
+		if len(items) == 0 {
+			break
+		}
+		members := make([]interface{}, len(items))
+		for i, item := range items {
+			members[i] = item
+		}
+		pipe := s.queueClient().Pipeline()
+		pipe.ZRem(s.Context, s.getQueueAgesID(), members...)
+		pipe.LTrim(s.Context, key, int64(len(items)), -1)
+		_, err = pipe.Exec(s.Context)
+		if err != nil {
+			return err
+		}
+	}
+	return s.queueClient().Del(s.Context, key).Err()
+}
+
+// QueueGeneration returns the active queue generation of this storage.
+func (s *Storage) QueueGeneration() int {
+	return int(atomic.LoadInt32(&s.generation))
+}
+
+// loadGeneration reads the active generation from redis.
+func (s *Storage) loadGeneration() error {
+	n, err := s.queueClient().Get(s.Context, s.getGenerationID()).Int()
+	if err == redis.Nil {
+		n = 0
+	} else if err != nil {
+		return err
+	}
+	atomic.StoreInt32(&s.generation, int32(n))
+	return nil
+}
+
+// pollGeneration reloads the active generation until Close.
+func (s *Storage) pollGeneration() {
+	ticker := time.NewTicker(s.GenerationPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+		err := s.do("QueueGeneration", s.loadGeneration)
+		if err != nil {
+			s.Logger.Printf("loadGeneration() error %s", err)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package collyredis
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+func TestClearResetsGeneration(t *testing.T) {
+	s, m := newTestStorage(t)
+	s.QueueGenerations = true
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	for i := 0; i < 2; i++ {
+		if _, err := s.NewQueueGeneration(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.AddRequest([]byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Clear(); err != nil {
+		t.Fatal(err)
+	}
+	if g := s.QueueGeneration(); g != 0 {
+		t.Fatalf("QueueGeneration() after Clear = %d, want 0", g)
+	}
+	if keys := m.Keys(); len(keys) != 0 {
+		t.Fatalf("keys left after Clear: %q", keys)
+	}
+}
+
+func TestNewQueueGenerationMigratesLaggingPushes(t *testing.T) {
+	s, m := newTestStorage(t)
+	s.QueueGenerations = true
+	s.GenerationPollInterval = 10 * time.Millisecond
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	lagging := &Storage{
+		Client:                 redis.NewClient(&redis.Options{Addr: m.Addr()}),
+		QueueGenerations:       true,
+		GenerationPollInterval: time.Hour,
+	}
+	if err := lagging.Init(); err != nil {
+		t.Fatal(err)
+	}
+	defer lagging.Close()
+
+	if err := s.AddRequest([]byte("old")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.NewQueueGeneration(); err != nil {
+		t.Fatal(err)
+	}
+	if err := lagging.AddRequest([]byte("late")); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	r, err := s.GetRequest()
+	if err != nil || string(r) != "late" {
+		t.Fatalf("GetRequest() = %q, %v, want the lagging push", r, err)
+	}
+	if _, err := s.GetRequest(); err != redis.Nil {
+		t.Fatalf("GetRequest() = %v, want redis.Nil, the old generation is discarded", err)
+	}
+}
+
+func TestInitChecksActiveGenerationType(t *testing.T) {
+	s, m := newTestStorage(t)
+	s.QueueGenerations = true
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.NewQueueGeneration(); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+	if err := m.Set(s.getGenerationQueueID(1), "x"); err != nil {
+		t.Fatal(err)
+	}
+	other := &Storage{Client: s.Client, QueueGenerations: true}
+	err := other.Init()
+	defer other.Close()
+	want := &ErrWrongKeyType{Key: s.getGenerationQueueID(1), Expected: "list", Actual: "string"}
+	if got, ok := err.(*ErrWrongKeyType); !ok || *got != *want {
+		t.Fatalf("Init() = %v, want %v", err, want)
+	}
+}
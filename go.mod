@@ -2,4 +2,10 @@ module github.com/hack-fan/collyredis
 
 go 1.16
 
-require github.com/go-redis/redis/v8 v8.8.2
+require (
+	github.com/alicebob/miniredis/v2 v2.23.0
+	github.com/go-redis/redis/v8 v8.8.2
+	github.com/klauspost/compress v1.13.6
+	github.com/prometheus/client_golang v1.11.0
+	github.com/yuin/gopher-lua v1.1.1 // indirect
+)
@@ -0,0 +1,124 @@
+package collyredis
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// HealthResult is the detailed outcome of a health check.
+type HealthResult struct {
+	// Latency is the round trip time of a PING.
+	Latency time.Duration
+
+	// ServerInfo holds the fields of the "server" section of INFO,
+	// e.g. "redis_version" or "uptime_in_seconds".
+	ServerInfo map[string]string
+}
+
+// HealthCheck returns an error if redis is not reachable.
+func (s *Storage) HealthCheck() error {
+	_, err := s.HealthCheckDetailed()
+	return err
+}
+
+// HealthCheckDetailed pings redis and reads a light INFO, so readiness
+// endpoints can report responsiveness and not only up or down.
+func (s *Storage) HealthCheckDetailed() (HealthResult, error) {
+	var res HealthResult
+	err := s.do("HealthCheck", func() (err error) {
+		res, err = s.healthCheck()
+		return err
+	})
+	return res, err
+}
+
+func (s *Storage) healthCheck() (HealthResult, error) {
+	var res HealthResult
+	start := time.Now()
+	err := s.client().Ping(s.Context).Err()
+	if err != nil {
+		return res, err
+	}
+	res.Latency = time.Since(start)
+	info, err := s.client().Info(s.Context, "server").Result()
+	if err != nil {
+		return res, err
+	}
+	res.ServerInfo = parseInfo(info)
+	return res, nil
+}
+
+// parseInfo parses the "field:value" lines of an INFO reply.
+func parseInfo(info string) map[string]string {
+	m := make(map[string]string)
+	for _, line := range strings.Split(info, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.IndexByte(line, ':')
+		if i < 0 {
+			continue
+		}
+		m[line[:i]] = line[i+1:]
+	}
+	return m
+}
+
+// Validate is a preflight check of the storage before crawling. It runs a
+// round trip of SET, GET, DEL, LPUSH, LLEN and RPOP on a scratch key
+// "<prefix>:__validate__" with the visited and queue clients, so ACL or
+// permission problems show up at startup instead of mid-crawl. It returns the
+// first failure and deletes the scratch key in any case.
+func (s *Storage) Validate() error {
+	return s.do("Validate", func() error {
+		key := s.Prefix + ":__validate__"
+		defer s.visitedClient().Del(s.Context, key)
+		defer s.queueClient().Del(s.Context, key)
+		err := s.validate(key)
+		if err != nil {
+			return fmt.Errorf("storage validation failed: %w", err)
+		}
+		return nil
+	})
+}
+
+func (s *Storage) validate(key string) error {
+	vc := s.visitedClient()
+	err := vc.Set(s.Context, key, "1", time.Minute).Err()
+	if err != nil {
+		return fmt.Errorf("SET: %w", err)
+	}
+	v, err := vc.Get(s.Context, key).Result()
+	if err != nil {
+		return fmt.Errorf("GET: %w", err)
+	}
+	if v != "1" {
+		return fmt.Errorf("GET: unexpected value %q", v)
+	}
+	err = vc.Del(s.Context, key).Err()
+	if err != nil {
+		return fmt.Errorf("DEL: %w", err)
+	}
+	qc := s.queueClient()
+	err = qc.LPush(s.Context, key, "1").Err()
+	if err != nil {
+		return fmt.Errorf("LPUSH: %w", err)
+	}
+	n, err := qc.LLen(s.Context, key).Result()
+	if err != nil {
+		return fmt.Errorf("LLEN: %w", err)
+	}
+	if n != 1 {
+		return fmt.Errorf("LLEN: unexpected length %d", n)
+	}
+	v, err = qc.RPop(s.Context, key).Result()
+	if err != nil {
+		return fmt.Errorf("RPOP: %w", err)
+	}
+	if v != "1" {
+		return fmt.Errorf("RPOP: unexpected value %q", v)
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package collyredis
+
+import (
+	"github.com/go-redis/redis/v8"
+)
+
+// releaseWorkerScript moves all of the in-flight list KEYS[1] back to the
+// consuming end of the queue KEYS[2], the oldest request first in line, and
+// returns how many were moved. With a DebugQueue mirror KEYS[3] their
+// summaries are pushed along, see mirrorSummaries for ARGV.
+var releaseWorkerScript = redis.NewScript(`
+local summaries = {}
+for i = 2, #ARGV, 2 do
+	summaries[ARGV[i]] = ARGV[i+1]
+end
+local n = 0
+while true do
+	local v = redis.call('LPOP', KEYS[1])
+	if not v then
+		return n
+	end
+	redis.call('RPUSH', KEYS[2], v)
+	if KEYS[3] then
+		redis.call('RPUSH', KEYS[3], summaries[v] or ARGV[1])
+	end
+	n = n + 1
+end
+`)
+
+// popInFlightScript moves the next request of the queue KEYS[1] to the
+// in-flight list KEYS[2], and when flagged pops its debug summary from KEYS[3]
+// and removes it from the queue ages KEYS[4].
+var popInFlightScript = redis.NewScript(`
+local v = redis.call('RPOPLPUSH', KEYS[1], KEYS[2])
+if v then
+	if ARGV[1] == '1' then
+		redis.call('RPOP', KEYS[3])
+	end
+	if ARGV[2] == '1' then
+		redis.call('ZREM', KEYS[4], v)
+	end
+end
+return v
+`)
+
+// GetRequestInFlight pops a request like GetRequest, but atomically keeps it
+// in the "<prefix>:inflight:<workerID>" list until AckRequest, so it is not
+// lost if the worker dies while processing it. It returns redis.Nil if the
+// queue is empty.
+func (s *Storage) GetRequestInFlight(workerID string) ([]byte, error) {
+	var v []byte
+	keys := append(s.queueKeyTypes(s.getQueueID()), typedKey{s.getInFlightID(workerID), "list"})
+	err := s.doWrite("GetRequestInFlight", func() (err error) {
+		if !s.DebugQueue && !s.TrackQueueAge {
+			v, err = s.queueClient().RPopLPush(s.Context, s.getQueueID(), s.getInFlightID(workerID)).Bytes()
+			return s.wrongKeyTypes(s.queueClient(), err, keys...)
+		}
+		var res string
+		res, err = popInFlightScript.Run(s.Context, s.queueClient(),
+			[]string{s.getQueueID(), s.getInFlightID(workerID), s.getQueueDebugID(), s.getQueueAgesID()},
+			flag(s.DebugQueue), flag(s.TrackQueueAge)).Text()
+		v = []byte(res)
+		return s.wrongKeyTypes(s.queueClient(), err, keys...)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s.decodeRequest(v)
+}
+
+// AckRequest removes the processed request r from the in-flight list of
+// workerID, see GetRequestInFlight. With PriorityHeader a prioritized copy
+// of r is matched as well.
+func (s *Storage) AckRequest(workerID string, r []byte) error {
+	v, err := s.encodeRequest(r)
+	if err != nil {
+		return err
+	}
+	key := s.getInFlightID(workerID)
+	return s.doWrite("AckRequest", func() error {
+		if s.PriorityHeader {
+			_, err := s.removeStored([]string{key}, 1, v)
+			return s.wrongKeyType(s.queueClient(), key, "list", err)
+		}
+		err := s.queueClient().LRem(s.Context, key, 1, v).Err()
+		return s.wrongKeyType(s.queueClient(), key, "list", err)
+	})
+}
+
+// ReleaseWorker moves all the unacked in-flight requests of workerID back to
+// the queue in one script, and returns how many were requeued. Call it when a
+// worker shuts down cleanly; the requests are put at the consuming end of the
+// queue, so they are redelivered first.
+func (s *Storage) ReleaseWorker(workerID string) (requeued int, err error) {
+	key := s.getQueueID()
+	var n int64
+	err = s.doWrite("ReleaseWorker", func() (err error) {
+		args, err := s.mirrorSummaries(s.getInFlightID(workerID))
+		if err != nil {
+			return s.wrongKeyType(s.queueClient(), s.getInFlightID(workerID), "list", err)
+		}
+		n, err = releaseWorkerScript.Run(s.Context, s.queueClient(),
+			s.mirrorKeys(s.getInFlightID(workerID), key), args...).Int64()
+		return s.wrongKeyTypes(s.queueClient(), err,
+			typedKey{s.getInFlightID(workerID), "list"}, typedKey{key, "list"})
+	})
+	if err != nil {
+		return 0, err
+	}
+	if n > 0 {
+		s.audit(AuditEnqueue, key)
+	}
+	return int(n), nil
+}
@@ -0,0 +1,68 @@
+package collyredis
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ErrWrongKeyType is returned when a key of the storage holds another redis
+// type than the storage uses, usually because the prefix collides with other
+// data or a previous run stored it in another form.
+type ErrWrongKeyType struct {
+	Key      string
+	Expected string
+	Actual   string
+}
+
+func (e *ErrWrongKeyType) Error() string {
+	return fmt.Sprintf("key %s holds a redis %s, but the storage expects a %s: use another Prefix or delete the key",
+		e.Key, e.Actual, e.Expected)
+}
+
+// wrongKeyType turns a WRONGTYPE error on key into an ErrWrongKeyType, with
+// the actual type probed from c. Other errors are returned as is.
+func (s *Storage) wrongKeyType(c RedisClient, key, expected string, err error) error {
+	if err == nil || !strings.Contains(err.Error(), "WRONGTYPE") {
+		return err
+	}
+	typ, terr := c.Type(s.Context, key).Result()
+	if terr != nil {
+		typ = "unknown type"
+	}
+	return &ErrWrongKeyType{Key: key, Expected: expected, Actual: typ}
+}
+
+// typedKey is a key and the redis type the storage expects it to hold.
+type typedKey struct {
+	key      string
+	expected string
+}
+
+// wrongKeyTypes is wrongKeyType for scripts and pipelines touching several
+// keys: it reports the first of keys holding another type than expected,
+// and falls back to the first key if none can be told apart.
+func (s *Storage) wrongKeyTypes(c RedisClient, err error, keys ...typedKey) error {
+	if err == nil || !strings.Contains(err.Error(), "WRONGTYPE") || len(keys) == 0 {
+		return err
+	}
+	for _, k := range keys {
+		typ, terr := c.Type(s.Context, k.key).Result()
+		if terr == nil && typ != "none" && typ != k.expected {
+			return &ErrWrongKeyType{Key: k.key, Expected: k.expected, Actual: typ}
+		}
+	}
+	return s.wrongKeyType(c, keys[0].key, keys[0].expected, err)
+}
+
+// queueKeyTypes returns the queue key with the debug mirror and the queue
+// ages written along with it, see pushRequest.
+func (s *Storage) queueKeyTypes(key string) []typedKey {
+	keys := []typedKey{{key, "list"}}
+	if s.DebugQueue {
+		keys = append(keys, typedKey{s.getQueueDebugID(), "list"})
+	}
+	if s.TrackQueueAge {
+		keys = append(keys, typedKey{s.getQueueAgesID(), "zset"})
+	}
+	return keys
+}
@@ -0,0 +1,91 @@
+package collyredis
+
+import (
+	"errors"
+	"net/url"
+	"testing"
+)
+
+func TestWrongKeyType(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(s *Storage)
+		key   func(s *Storage) string
+		want  ErrWrongKeyType
+		call  func(s *Storage) error
+	}{
+		{
+			name:  "queue ages of GetRequest",
+			setup: func(s *Storage) { s.TrackQueueAge = true },
+			key:   (*Storage).getQueueAgesID,
+			want:  ErrWrongKeyType{Expected: "zset", Actual: "string"},
+			call: func(s *Storage) error {
+				if err := s.Client.LPush(s.Context, s.getQueueID(), "a").Err(); err != nil {
+					return err
+				}
+				_, err := s.GetRequest()
+				return err
+			},
+		},
+		{
+			name: "queue of RotateQueue",
+			key:  (*Storage).getQueueID,
+			want: ErrWrongKeyType{Expected: "list", Actual: "string"},
+			call: func(s *Storage) error { return s.RotateQueue(1) },
+		},
+		{
+			name: "in-flight list of AckRequest",
+			key:  func(s *Storage) string { return s.getInFlightID("w1") },
+			want: ErrWrongKeyType{Expected: "list", Actual: "string"},
+			call: func(s *Storage) error { return s.AckRequest("w1", []byte("a")) },
+		},
+		{
+			name:  "visited key of a coalesced IsVisited",
+			setup: func(s *Storage) { s.CoalesceReads = true },
+			key:   func(s *Storage) string { return s.getIDStr(1) },
+			want:  ErrWrongKeyType{Expected: "string", Actual: "list"},
+			call: func(s *Storage) error {
+				_, err := s.IsVisited(1)
+				return err
+			},
+		},
+		{
+			name: "cookies of CookieTTL",
+			key:  func(s *Storage) string { return s.getCookieID("example.com") },
+			want: ErrWrongKeyType{Expected: "string", Actual: "list"},
+			call: func(s *Storage) error {
+				_, err := s.CookieTTL(&url.URL{Host: "example.com"})
+				return err
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, _ := newTestStorage(t)
+			if tt.setup != nil {
+				tt.setup(s)
+			}
+			if err := s.Init(); err != nil {
+				t.Fatal(err)
+			}
+			key := tt.key(s)
+			var err error
+			if tt.want.Actual == "list" {
+				err = s.Client.LPush(s.Context, key, "x").Err()
+			} else {
+				err = s.Client.Set(s.Context, key, "x", 0).Err()
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got *ErrWrongKeyType
+			if err := tt.call(s); !errors.As(err, &got) {
+				t.Fatalf("error = %v, want an ErrWrongKeyType", err)
+			}
+			tt.want.Key = key
+			if *got != tt.want {
+				t.Fatalf("error = %+v, want %+v", *got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,76 @@
+package collyredis
+
+import (
+	"errors"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// ErrNotLeader is returned when renewing or resigning a leadership which
+// expired or was taken by another instance.
+var ErrNotLeader = errors.New("leadership is not held")
+
+// renewLeaderScript extends the lock KEYS[1] by ARGV[2] milliseconds if it
+// still holds the token ARGV[1].
+var renewLeaderScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) ~= ARGV[1] then
+	return 0
+end
+return redis.call('PEXPIRE', KEYS[1], ARGV[2])
+`)
+
+// resignLeaderScript deletes the lock KEYS[1] if it still holds ARGV[1].
+var resignLeaderScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) ~= ARGV[1] then
+	return 0
+end
+return redis.call('DEL', KEYS[1])
+`)
+
+// BecomeLeader tries to become the single leader of the crawl for ttl, e.g.
+// to run the seeding or sweeping on one instance only. If another instance
+// leads, isLeader is false. Otherwise renew extends the leadership by ttl and
+// resign gives it up; both fail with ErrNotLeader once it was lost. The lock
+// is "<prefix>:leader".
+//
+// Leadership is only as good as the clock: a process paused beyond ttl can
+// still believe it leads after another took over. Work which must never run
+// twice needs a fencing token checked by the resource it writes to.
+func (s *Storage) BecomeLeader(ttl time.Duration) (isLeader bool, renew func() error, resign func() error, err error) {
+	token, err := newToken()
+	if err != nil {
+		return false, nil, nil, err
+	}
+	key := s.getLeaderID()
+	err = s.doWrite("BecomeLeader", func() (err error) {
+		isLeader, err = s.client().SetNX(s.Context, key, token, ttl).Result()
+		return err
+	})
+	if err != nil || !isLeader {
+		return false, nil, nil, err
+	}
+	renew = func() error {
+		return s.runLeaderScript("RenewLeader", renewLeaderScript, key, token, ttl.Milliseconds())
+	}
+	resign = func() error {
+		return s.runLeaderScript("ResignLeader", resignLeaderScript, key, token)
+	}
+	return true, renew, resign, nil
+}
+
+// runLeaderScript runs a compare-and-set script on the leader lock.
+func (s *Storage) runLeaderScript(op string, script *redis.Script, key string, args ...interface{}) error {
+	var n int64
+	err := s.doWrite(op, func() (err error) {
+		n, err = script.Run(s.Context, s.client(), []string{key}, args...).Int64()
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotLeader
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package collyredis
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// do runs one storage operation. Every exported method that talks to redis
+// goes through it exactly once, so it must not be called from within fn.
+func (s *Storage) do(op string, fn func() error) error {
+	if s.sem != nil {
+		select {
+		case s.sem <- struct{}{}:
+		case <-s.Context.Done():
+			return s.Context.Err()
+		}
+		defer func() { <-s.sem }()
+	}
+	atomic.AddInt32(&s.inFlight, 1)
+	defer atomic.AddInt32(&s.inFlight, -1)
+	defer s.observe(op, time.Now())
+	err := fn()
+	backoff := s.RetryBackoff
+	for attempt := 1; attempt <= s.MaxRetries && isConnError(err); attempt++ {
+		if s.OnRetry != nil {
+			s.OnRetry(op, attempt, err)
+		}
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-s.Context.Done():
+			timer.Stop()
+			return s.Context.Err()
+		}
+		backoff *= 2
+		err = fn()
+	}
+	if s.failover.perOp {
+		s.observeFailover(err)
+	}
+	s.recordError(err)
+	return err
+}
+
+// doWrite runs a mutating storage operation. With ClearExclusive it waits
+// while Clear is running, in this process or another one.
+func (s *Storage) doWrite(op string, fn func() error) error {
+	if s.ClearExclusive {
+		s.clearMu.RLock()
+		defer s.clearMu.RUnlock()
+		if err := s.waitClearing(); err != nil {
+			return err
+		}
+	}
+	return s.do(op, fn)
+}
+
+// InFlight returns how many storage operations are running right now.
+func (s *Storage) InFlight() int {
+	return int(atomic.LoadInt32(&s.inFlight))
+}
@@ -0,0 +1,105 @@
+package collyredis
+
+import (
+	"bytes"
+	"errors"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// priorityMagic starts the priority header of a queued request.
+//
+// With PriorityHeader, AddRequestWithPriority stores a request as
+//
+//	0xFF 'p' <priority byte> <stored request>
+//
+// where the stored request is what AddRequest would store, i.e. compressed
+// and tagged if a Compressor is set. The header stays uncompressed, so tools
+// reading the list with LRANGE can see the priorities without decoding.
+var priorityMagic = []byte{0xFF, 'p'}
+
+// removeStoredScript removes the entries of KEYS[1] equal to one of the
+// stored forms ARGV[2..], with or without a priority header, and their ages
+// from KEYS[2] if given. The list is scanned in pages before removing, and
+// with a count ARGV[1] above zero at most that many entries are removed.
+var removeStoredScript = redis.NewScript(`
+local want = {}
+for i = 2, #ARGV do want[ARGV[i]] = true end
+local limit = tonumber(ARGV[1])
+local matched, seen = {}, {}
+local start = 0
+while true do
+	local items = redis.call('LRANGE', KEYS[1], start, start + 499)
+	for _, v in ipairs(items) do
+		if not seen[v] and (want[v] or (string.sub(v, 1, 2) == '\255p' and want[string.sub(v, 4)])) then
+			seen[v] = true
+			matched[#matched + 1] = v
+		end
+	end
+	if #items < 500 or (limit > 0 and #matched > 0) then break end
+	start = start + 500
+end
+local removed = 0
+for _, v in ipairs(matched) do
+	if limit > 0 and removed >= limit then break end
+	local count = 0
+	if limit > 0 then count = limit - removed end
+	removed = removed + redis.call('LREM', KEYS[1], count, v)
+	if KEYS[2] then redis.call('ZREM', KEYS[2], v) end
+end
+return removed
+`)
+
+// AddRequestWithPriority pushes a request tagged with a priority hint, which
+// GetRequestWithPriority returns. The hint is only metadata: the queue stays
+// FIFO. It needs PriorityHeader; all the pop methods strip the header.
+func (s *Storage) AddRequestWithPriority(r []byte, priority byte) error {
+	if !s.PriorityHeader {
+		return errors.New("priority header is not enabled")
+	}
+	if skip, err := s.checkPayload(r); skip {
+		return err
+	}
+	v, err := s.encodeRequest(r)
+	if err != nil {
+		return err
+	}
+	v = append(append(append([]byte{}, priorityMagic...), priority), v...)
+	key := s.getQueueID()
+	size := int64(-1)
+	err = s.doWrite("AddRequestWithPriority", func() (err error) {
+		size, err = s.pushStored(key, r, v)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	s.observeWatermark(size)
+	s.audit(AuditEnqueue, key)
+	return nil
+}
+
+// GetRequestWithPriority pops a request like GetRequest and returns its
+// priority hint, zero for requests pushed without one.
+func (s *Storage) GetRequestWithPriority() (r []byte, priority byte, err error) {
+	return s.getRequest("GetRequestWithPriority")
+}
+
+// removeStored removes up to count entries of key matching one of the stored
+// forms, zero for all of them, including the prioritized copies.
+func (s *Storage) removeStored(keys []string, count int, forms ...[]byte) (int64, error) {
+	args := []interface{}{count}
+	for _, v := range forms {
+		args = append(args, v)
+	}
+	return removeStoredScript.Run(s.Context, s.queueClient(), keys, args...).Int64()
+}
+
+// splitPriority splits the priority header from a stored request. Without a
+// header or PriorityHeader it returns zero and v.
+func (s *Storage) splitPriority(v []byte) (byte, []byte) {
+	if !s.PriorityHeader || len(v) < 3 || !bytes.HasPrefix(v, priorityMagic) {
+		return 0, v
+	}
+	return v[2], v[3:]
+}
@@ -0,0 +1,125 @@
+package collyredis
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestRemoveRequestPrioritized(t *testing.T) {
+	s, m := newTestStorage(t)
+	s.PriorityHeader = true
+	s.TrackQueueAge = true
+	s.Compressor = GzipCompressor{}
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+	r := []byte(`{"URL":"http://example.com/a"}`)
+	if err := s.AddRequestWithPriority(r, 7); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddRequest(r); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddRequest([]byte(`{"URL":"http://example.com/b"}`)); err != nil {
+		t.Fatal(err)
+	}
+	removed, err := s.RemoveRequest(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 2 {
+		t.Fatalf("RemoveRequest() = %d, want 2", removed)
+	}
+	if n, _ := s.QueueSize(); n != 1 {
+		t.Fatalf("QueueSize() = %d, want 1", n)
+	}
+	if ages, _ := m.ZMembers(s.getQueueAgesID()); len(ages) != 1 {
+		t.Fatalf("%d queue ages left, want 1", len(ages))
+	}
+}
+
+func TestAckRequestPrioritized(t *testing.T) {
+	s, _ := newTestStorage(t)
+	s.PriorityHeader = true
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddRequestWithPriority([]byte("a"), 3); err != nil {
+		t.Fatal(err)
+	}
+	r, err := s.GetRequestInFlight("w1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AckRequest("w1", r); err != nil {
+		t.Fatal(err)
+	}
+	n, err := s.Client.LLen(s.Context, s.getInFlightID("w1")).Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Fatalf("%d in-flight requests left, want 0", n)
+	}
+}
+
+func TestGetRequestWithPriorityDeadLetters(t *testing.T) {
+	s, _ := newTestStorage(t)
+	s.PriorityHeader = true
+	s.Compressor = GzipCompressor{}
+	s.UnmarshalErrorPolicy = DeadLetterUnmarshalError
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+	bad := append(append([]byte{}, priorityMagic...), 9, GzipCompressor{}.Tag(), 'x')
+	if err := s.Client.LPush(s.Context, s.getQueueID(), bad).Err(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddRequestWithPriority([]byte("a"), 3); err != nil {
+		t.Fatal(err)
+	}
+	r, priority, err := s.GetRequestWithPriority()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(r) != "a" || priority != 3 {
+		t.Fatalf("GetRequestWithPriority() = %q, %d, want \"a\", 3", r, priority)
+	}
+	n, err := s.Client.LLen(s.Context, s.getDeadLetterID()).Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Fatalf("%d dead letters, want 1", n)
+	}
+}
+
+func TestPriorityWatermarks(t *testing.T) {
+	s, _ := newTestStorage(t)
+	s.PriorityHeader = true
+	s.HighWatermark = 2
+	var crossed []string
+	s.OnWatermarkCrossed = func(level string, size int) {
+		crossed = append(crossed, fmt.Sprintf("%s %d", level, size))
+	}
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := s.AddRequestWithPriority([]byte("a"), 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, _, err := s.GetRequestWithPriority(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, _, err := s.GetRequestIsLast(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if want := []string{"high 2", "low 0"}; !reflect.DeepEqual(crossed, want) {
+		t.Fatalf("crossed %q, want %q", crossed, want)
+	}
+}
@@ -0,0 +1,107 @@
+package collyredis
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// promCacheTTL is how long a scrape reuses the gauges read from redis.
+const promCacheTTL = time.Second
+
+// promCollector is the collector returned by PrometheusCollector.
+type promCollector struct {
+	s            *Storage
+	up           *prometheus.Desc
+	queueSize    *prometheus.Desc
+	visitedCount *prometheus.Desc
+	latency      *prometheus.HistogramVec
+
+	mu       sync.Mutex
+	readAt   time.Time
+	ok       bool
+	queue    float64
+	visited  float64
+	counting bool
+}
+
+// PrometheusCollector returns a collector exposing the queue size, the
+// visited count (with CountVisited) and the latency of every operation.
+// The gauges are read from redis on scrape and cached for a second; if redis
+// fails they are left out and colly_redis_up is 0. It returns the same
+// collector on every call so it is registered once.
+func (s *Storage) PrometheusCollector() prometheus.Collector {
+	s.promOnce.Do(func() {
+		s.metrics.Store(&promCollector{
+			s:  s,
+			up: prometheus.NewDesc("colly_redis_up", "Whether the last read of the gauges from redis succeeded.", nil, nil),
+			queueSize: prometheus.NewDesc("colly_redis_queue_size",
+				"Number of queued requests.", nil, nil),
+			visitedCount: prometheus.NewDesc("colly_redis_visited_count",
+				"Estimated number of distinct visited requests.", nil, nil),
+			latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+				Name: "colly_redis_operation_duration_seconds",
+				Help: "Latency of the storage operations, retries included.",
+			}, []string{"op"}),
+		})
+	})
+	return s.metrics.Load().(*promCollector)
+}
+
+// observe records the latency of op if a collector was created.
+func (s *Storage) observe(op string, start time.Time) {
+	if c, ok := s.metrics.Load().(*promCollector); ok {
+		c.latency.WithLabelValues(op).Observe(time.Since(start).Seconds())
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (c *promCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.up
+	ch <- c.queueSize
+	ch <- c.visitedCount
+	c.latency.Describe(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (c *promCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	if time.Since(c.readAt) > promCacheTTL {
+		c.read()
+	}
+	ok, queue, visited, counting := c.ok, c.queue, c.visited, c.counting
+	c.mu.Unlock()
+	if ok {
+		ch <- prometheus.MustNewConstMetric(c.up, prometheus.GaugeValue, 1)
+		ch <- prometheus.MustNewConstMetric(c.queueSize, prometheus.GaugeValue, queue)
+		if counting {
+			ch <- prometheus.MustNewConstMetric(c.visitedCount, prometheus.GaugeValue, visited)
+		}
+	} else {
+		ch <- prometheus.MustNewConstMetric(c.up, prometheus.GaugeValue, 0)
+	}
+	c.latency.Collect(ch)
+}
+
+// read refreshes the cached gauges, c.mu must be held.
+func (c *promCollector) read() {
+	c.readAt = time.Now()
+	c.ok = false
+	n, err := c.s.QueueSize()
+	if err != nil {
+		c.s.Logger.Printf("PrometheusCollector() queue size error %s", err)
+		return
+	}
+	c.queue = float64(n)
+	c.counting = c.s.CountVisited
+	if c.counting {
+		v, err := c.s.VisitedCount()
+		if err != nil {
+			c.s.Logger.Printf("PrometheusCollector() visited count error %s", err)
+			return
+		}
+		c.visited = float64(v)
+	}
+	c.ok = true
+}
@@ -0,0 +1,1003 @@
+package collyredis
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// pageSize is how many entries are read or written per round trip
+// by the methods that walk a whole list or keyspace.
+const pageSize = 500
+
+// ErrLockNotHeld is returned by CommitPeek when the lock has expired
+// or belongs to another token.
+var ErrLockNotHeld = errors.New("peek lock is not held")
+
+// ErrHostQueueFull is returned by AddRequestForHost when the queue of the
+// host already holds MaxPerHostQueue requests.
+var ErrHostQueueFull = errors.New("host queue is full")
+
+// ErrQueueAgeNotTracked is returned by QueueAgeHistogram without TrackQueueAge.
+var ErrQueueAgeNotTracked = errors.New("queue age is not tracked")
+
+// pushRequestScript pushes a request, its debug summary and its enqueue time.
+// Empty arguments skip the debug list and the timestamp.
+var pushRequestScript = redis.NewScript(`
+if ARGV[2] ~= '' then
+	redis.call('LPUSH', KEYS[2], ARGV[2])
+end
+if ARGV[3] ~= '' then
+	redis.call('ZADD', KEYS[3], ARGV[3], ARGV[1])
+end
+return redis.call('LPUSH', KEYS[1], ARGV[1])
+`)
+
+// popRequestScript pops a request and, when flagged, its debug summary
+// and its enqueue time.
+var popRequestScript = redis.NewScript(`
+local v = redis.call('RPOP', KEYS[1])
+if v then
+	if ARGV[1] == '1' then
+		redis.call('RPOP', KEYS[2])
+	end
+	if ARGV[2] == '1' then
+		redis.call('ZREM', KEYS[3], v)
+	end
+end
+return v
+`)
+
+// addRequestDebouncedScript pushes a request unless its debounce key exists.
+var addRequestDebouncedScript = redis.NewScript(`
+if not redis.call('SET', KEYS[1], '1', 'NX', 'PX', ARGV[1]) then
+	return 0
+end
+redis.call('LPUSH', KEYS[2], ARGV[2])
+return 1
+`)
+
+// addRequestCappedScript pushes ARGV[2] to KEYS[1] unless it already holds
+// ARGV[1] (if positive) entries. It returns 0 if full.
+var addRequestCappedScript = redis.NewScript(`
+local max = tonumber(ARGV[1])
+if max > 0 and redis.call('LLEN', KEYS[1]) >= max then
+	return 0
+end
+redis.call('LPUSH', KEYS[1], ARGV[2])
+return 1
+`)
+
+// addRequestsDedupScript pushes each request ARGV[2i] whose hash ARGV[2i-1]
+// is new to the set KEYS[1] to the queue KEYS[2]. It returns a 1 for every
+// pushed request and a 0 for every skipped one.
+var addRequestsDedupScript = redis.NewScript(`
+local added = {}
+for i = 1, #ARGV, 2 do
+	if redis.call('SADD', KEYS[1], ARGV[i]) == 1 then
+		redis.call('LPUSH', KEYS[2], ARGV[i+1])
+		added[#added+1] = 1
+	else
+		added[#added+1] = 0
+	end
+end
+return added
+`)
+
+// moveRequestsScript moves every request in ARGV from the list KEYS[1]
+// to the list KEYS[2], and returns how many were moved. They are removed
+// from the queue ages KEYS[3] if given, see ageKeys.
+var moveRequestsScript = redis.NewScript(`
+local n = 0
+for _, v in ipairs(ARGV) do
+	if redis.call('LREM', KEYS[1], 1, v) > 0 then
+		redis.call('LPUSH', KEYS[2], v)
+		if KEYS[3] then
+			redis.call('ZREM', KEYS[3], v)
+		end
+		n = n + 1
+	end
+end
+return n
+`)
+
+// releaseRequestsScript moves all of the list KEYS[1] back to the queue
+// KEYS[2], keeping their order, and returns how many were moved. With a
+// DebugQueue mirror KEYS[3] their summaries are pushed along, see
+// mirrorSummaries for ARGV.
+var releaseRequestsScript = redis.NewScript(`
+local summaries = {}
+for i = 2, #ARGV, 2 do
+	summaries[ARGV[i]] = ARGV[i+1]
+end
+local n = 0
+while true do
+	local v = redis.call('LPOP', KEYS[1])
+	if not v then
+		return n
+	end
+	redis.call('LPUSH', KEYS[2], v)
+	if KEYS[3] then
+		redis.call('LPUSH', KEYS[3], summaries[v] or ARGV[1])
+	end
+	n = n + 1
+end
+`)
+
+// moveListScript moves all of the list KEYS[1] to the list KEYS[2], keeping
+// their order, and returns how many were moved. They go to the consuming end
+// of KEYS[2] if ARGV[1] is '1', i.e. they are older than its entries, and
+// to the other end otherwise. Without a KEYS[2] the list is renamed.
+var moveListScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[2]) == 0 then
+	if redis.call('EXISTS', KEYS[1]) == 0 then
+		return 0
+	end
+	redis.call('RENAME', KEYS[1], KEYS[2])
+	return redis.call('LLEN', KEYS[2])
+end
+local n = 0
+while true do
+	local v
+	if ARGV[1] == '1' then
+		v = redis.call('LPOP', KEYS[1])
+	else
+		v = redis.call('RPOP', KEYS[1])
+	end
+	if not v then
+		return n
+	end
+	if ARGV[1] == '1' then
+		redis.call('RPUSH', KEYS[2], v)
+	else
+		redis.call('LPUSH', KEYS[2], v)
+	end
+	n = n + 1
+end
+`)
+
+// getRequestIsLastScript pops a request like popRequestScript and reports
+// whether the queue is empty afterwards.
+var getRequestIsLastScript = redis.NewScript(`
+local v = redis.call('RPOP', KEYS[1])
+if not v then
+	return false
+end
+if ARGV[1] == '1' then
+	redis.call('RPOP', KEYS[2])
+end
+if ARGV[2] == '1' then
+	redis.call('ZREM', KEYS[3], v)
+end
+return {v, redis.call('LLEN', KEYS[1])}
+`)
+
+// trimMirrorScript trims the DebugQueue mirror KEYS[2] to the length of the
+// queue KEYS[1].
+var trimMirrorScript = redis.NewScript(`
+local n = redis.call('LLEN', KEYS[1])
+if n == 0 then
+	redis.call('DEL', KEYS[2])
+else
+	redis.call('LTRIM', KEYS[2], 0, n - 1)
+end
+return n
+`)
+
+// checkPayload applies EmptyPayloadPolicy. It reports whether r must not be
+// pushed, and the error to return in that case.
+func (s *Storage) checkPayload(r []byte) (bool, error) {
+	if len(bytes.TrimSpace(r)) > 0 {
+		return false, nil
+	}
+	if s.EmptyPayloadPolicy == SkipEmptyPayload {
+		return true, nil
+	}
+	return true, ErrEmptyPayload
+}
+
+// pushRequest pushes r to the queue key and returns the new queue size. The
+// debug mirror and the enqueue time are written in the same script when they
+// are enabled.
+func (s *Storage) pushRequest(key string, r []byte) (int64, error) {
+	v, err := s.encodeRequest(r)
+	if err != nil {
+		return 0, err
+	}
+	return s.pushStored(key, r, v)
+}
+
+// pushStored pushes the stored form v of r, see pushRequest.
+func (s *Storage) pushStored(key string, r, v []byte) (int64, error) {
+	if !s.DebugQueue && !s.TrackQueueAge {
+		return s.queueClient().LPush(s.Context, key, v).Result()
+	}
+	summary, score, err := s.mirrorArgs(r)
+	if err != nil {
+		return 0, err
+	}
+	return pushRequestScript.Run(s.Context, s.queueClient(),
+		[]string{key, s.getQueueDebugID(), s.getQueueAgesID()}, v, summary, score).Int64()
+}
+
+// mirrorArgs returns the debug summary and the enqueue time of r for the
+// scripts pushing to the queue, empty when DebugQueue or TrackQueueAge is
+// off, see pushRequestScript.
+func (s *Storage) mirrorArgs(r []byte) (summary, score string, err error) {
+	if s.DebugQueue {
+		summary = summarizeRequest(r)
+	}
+	if s.TrackQueueAge {
+		now, err := serverTime(s.Context, s.queueClient())
+		if err != nil {
+			return "", "", err
+		}
+		score = strconv.FormatInt(unixMilli(now), 10)
+	}
+	return summary, score, nil
+}
+
+// mirrorKeys returns keys followed by the DebugQueue mirror key if it is
+// enabled, for the scripts moving requests back to the queue.
+func (s *Storage) mirrorKeys(keys ...string) []string {
+	if s.DebugQueue {
+		keys = append(keys, s.getQueueDebugID())
+	}
+	return keys
+}
+
+// mirrorSummaries returns the script arguments mapping the stored requests
+// of the list key to their DebugQueue summaries: the summary of entries
+// added meanwhile, followed by every entry and its summary. It is empty
+// without DebugQueue.
+func (s *Storage) mirrorSummaries(key string) ([]interface{}, error) {
+	if !s.DebugQueue {
+		return nil, nil
+	}
+	items, err := s.queueClient().LRange(s.Context, key, 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	args := []interface{}{summarizeRequest(nil)}
+	for _, item := range items {
+		r, err := s.decodeRequest([]byte(item))
+		if err != nil {
+			r = nil
+		}
+		args = append(args, item, summarizeRequest(r))
+	}
+	return args, nil
+}
+
+// trimMirror trims the DebugQueue mirror to the length of the queue key
+// after requests were removed from the middle of the queue, which cannot
+// be mirrored by index. It keeps the mirror bounded, but may shift it.
+func (s *Storage) trimMirror(key string) error {
+	if !s.DebugQueue {
+		return nil
+	}
+	return trimMirrorScript.Run(s.Context, s.queueClient(), []string{key, s.getQueueDebugID()}).Err()
+}
+
+// ageKeys returns keys followed by the queue ages key with TrackQueueAge,
+// for the scripts removing requests from the queue by other means than
+// popRequest.
+func (s *Storage) ageKeys(keys ...string) []string {
+	if s.TrackQueueAge {
+		keys = append(keys, s.getQueueAgesID())
+	}
+	return keys
+}
+
+// popRequest pops the next request of the queue key, see pushRequest.
+// It returns the stored form, which the caller decodes.
+func (s *Storage) popRequest(key string) ([]byte, error) {
+	if !s.DebugQueue && !s.TrackQueueAge {
+		return s.queueClient().RPop(s.Context, key).Bytes()
+	}
+	v, err := popRequestScript.Run(s.Context, s.queueClient(),
+		[]string{key, s.getQueueDebugID(), s.getQueueAgesID()},
+		flag(s.DebugQueue), flag(s.TrackQueueAge)).Text()
+	if err != nil {
+		return nil, err
+	}
+	return []byte(v), nil
+}
+
+// QueueAgeHistogram counts the queued requests by how long they have been
+// waiting. For every bucket the result holds the number of requests whose age
+// is less than the bucket but at least the previous (smaller) bucket; requests
+// older than the largest bucket are not counted. It needs TrackQueueAge.
+func (s *Storage) QueueAgeHistogram(buckets []time.Duration) (map[time.Duration]int, error) {
+	if !s.TrackQueueAge {
+		return nil, ErrQueueAgeNotTracked
+	}
+	sorted := append([]time.Duration(nil), buckets...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	hist := make(map[time.Duration]int, len(sorted))
+	err := s.do("QueueAgeHistogram", func() error {
+		t, err := serverTime(s.Context, s.queueClient())
+		if err != nil {
+			return err
+		}
+		now := unixMilli(t)
+		pipe := s.queueClient().Pipeline()
+		cmds := make([]*redis.IntCmd, len(sorted))
+		var prev time.Duration
+		for i, b := range sorted {
+			min := "(" + strconv.FormatInt(now-b.Milliseconds(), 10)
+			max := strconv.FormatInt(now-prev.Milliseconds(), 10)
+			cmds[i] = pipe.ZCount(s.Context, s.getQueueAgesID(), min, max)
+			prev = b
+		}
+		_, err = pipe.Exec(s.Context)
+		if err != nil {
+			return err
+		}
+		for i, b := range sorted {
+			hist[b] = int(cmds[i].Val())
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return hist, nil
+}
+
+// flag formats a bool as a script argument.
+func flag(b bool) string {
+	if b {
+		return "1"
+	}
+	return "0"
+}
+
+// RotateQueue moves the n requests that would be dequeued next to the back
+// of the queue. Every step is a single atomic RPOPLPUSH on the queue key,
+// so no request is ever lost or duplicated, but the cost is O(n) round trips.
+// It is meant for small rotations, not for shuffling the whole queue.
+func (s *Storage) RotateQueue(n int) error {
+	key := s.getQueueID()
+	return s.doWrite("RotateQueue", func() error {
+		for i := 0; i < n; i++ {
+			pipe := s.queueClient().Pipeline()
+			cmd := pipe.RPopLPush(s.Context, key, key)
+			if s.DebugQueue {
+				pipe.RPopLPush(s.Context, s.getQueueDebugID(), s.getQueueDebugID())
+			}
+			_, _ = pipe.Exec(s.Context)
+			err := cmd.Err()
+			if err == redis.Nil {
+				return nil
+			} else if err != nil {
+				return s.wrongKeyType(s.queueClient(), key, "list", err)
+			}
+		}
+		return nil
+	})
+}
+
+// GetRequestIsLast works like GetRequest, but also reports whether the
+// returned request was the last one in the queue. Both happen atomically in
+// a script, so a request pushed right after the pop is never missed.
+// It returns redis.Nil if the queue is empty.
+func (s *Storage) GetRequestIsLast() (payload []byte, wasLast bool, err error) {
+	key := s.getQueueID()
+	size := int64(-1)
+	err = s.doWrite("GetRequestIsLast", func() error {
+		for {
+			v, err := getRequestIsLastScript.Run(s.Context, s.queueClient(),
+				[]string{key, s.getQueueDebugID(), s.getQueueAgesID()},
+				flag(s.DebugQueue), flag(s.TrackQueueAge)).Result()
+			if err == redis.Nil {
+				size = 0
+			}
+			if err != nil {
+				return s.wrongKeyTypes(s.queueClient(), err, s.queueKeyTypes(key)...)
+			}
+			res := v.([]interface{})
+			size = res[1].(int64)
+			var retry bool
+			payload, retry, err = s.decodePopped("GetRequestIsLast", []byte(res[0].(string)))
+			if !retry {
+				return err
+			}
+		}
+	})
+	s.observeWatermark(size)
+	if err != nil {
+		return nil, false, err
+	}
+	return payload, size == 0, nil
+}
+
+// AddRequestPartitioned pushes a request to the partitioned queue chosen by
+// requestID modulo Partitions. Workers that each consume their own
+// partitions with GetRequestPartition never contend on a single queue key.
+func (s *Storage) AddRequestPartitioned(requestID uint64, r []byte) error {
+	if s.Partitions <= 0 {
+		return errors.New("queue partitions are not configured")
+	}
+	if skip, err := s.checkPayload(r); skip {
+		return err
+	}
+	v, err := s.encodeRequest(r)
+	if err != nil {
+		return err
+	}
+	key := s.getPartitionID(int(requestID % uint64(s.Partitions)))
+	err = s.doWrite("AddRequestPartitioned", func() error {
+		err := s.queueClient().LPush(s.Context, key, v).Err()
+		return s.wrongKeyType(s.queueClient(), key, "list", err)
+	})
+	if err != nil {
+		return err
+	}
+	s.audit(AuditEnqueue, key)
+	return nil
+}
+
+// GetRequestPartition pops a request from partition p, which is in the
+// range [0, Partitions). It returns redis.Nil if the partition is empty.
+func (s *Storage) GetRequestPartition(p int) ([]byte, error) {
+	if p < 0 || p >= s.Partitions {
+		return nil, fmt.Errorf("queue partition %d out of range", p)
+	}
+	return s.popDecoded("GetRequestPartition", s.getPartitionID(p))
+}
+
+// AddRequestDebounced pushes a request unless the same requestID was pushed
+// for host within window, and reports whether it was pushed. It damps enqueue
+// storms of hosts whose pages heavily link to each other. Unlike the visited
+// state the debounce is temporary: after window the request can be pushed
+// again, visited or not. The debounce key and the push are set in one
+// script; the DebugQueue and TrackQueueAge mirrors are not written.
+func (s *Storage) AddRequestDebounced(host string, requestID uint64, r []byte, window time.Duration) (bool, error) {
+	if skip, err := s.checkPayload(r); skip {
+		return false, err
+	}
+	v, err := s.encodeRequest(r)
+	if err != nil {
+		return false, err
+	}
+	ms := window.Milliseconds()
+	if ms < 1 {
+		ms = 1
+	}
+	key := s.getQueueID()
+	var n int64
+	err = s.doWrite("AddRequestDebounced", func() (err error) {
+		n, err = addRequestDebouncedScript.Run(s.Context, s.queueClient(),
+			[]string{s.getDebounceID(host, requestID), key}, ms, v).Int64()
+		return err
+	})
+	if err != nil || n == 0 {
+		return false, err
+	}
+	s.audit(AuditEnqueue, key)
+	return true, nil
+}
+
+// AddRequestsDedup pushes the requests which were never pushed by it
+// before, and reports for every item in order whether it was pushed. Requests
+// are identified by the sha1 of their payload, kept in the
+// "<prefix>:queue:seen" set until Clear. The whole batch runs in one script,
+// so concurrent batches never both push the same request, and duplicates
+// within the batch are pushed once. Empty payloads follow EmptyPayloadPolicy;
+// skipped ones are reported as not pushed. The DebugQueue and TrackQueueAge
+// mirrors are not written.
+func (s *Storage) AddRequestsDedup(items [][]byte) (added []bool, err error) {
+	added = make([]bool, len(items))
+	var idx []int
+	var args []interface{}
+	for i, r := range items {
+		if skip, err := s.checkPayload(r); skip {
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		v, err := s.encodeRequest(r)
+		if err != nil {
+			return nil, err
+		}
+		sum := sha1.Sum(r)
+		idx = append(idx, i)
+		args = append(args, hex.EncodeToString(sum[:]), v)
+	}
+	if len(idx) == 0 {
+		return added, nil
+	}
+	key := s.getQueueID()
+	var res interface{}
+	err = s.doWrite("AddRequestsDedup", func() (err error) {
+		res, err = addRequestsDedupScript.Run(s.Context, s.queueClient(),
+			[]string{s.getQueueSeenID(), key}, args...).Result()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	pushed := false
+	for j, v := range res.([]interface{}) {
+		if v.(int64) == 1 {
+			added[idx[j]] = true
+			pushed = true
+		}
+	}
+	if pushed {
+		s.audit(AuditEnqueue, key)
+	}
+	return added, nil
+}
+
+// AddRequestForHost pushes a request to the queue of host, a separate
+// "<prefix>:queue:host:<host>" list read by GetRequestForHost, so the
+// requests of a single host cannot fill the whole queue. It fails with
+// ErrHostQueueFull when that queue already holds MaxPerHostQueue requests.
+// The cap only applies to requests enqueued with their host this way.
+func (s *Storage) AddRequestForHost(host string, r []byte) error {
+	if skip, err := s.checkPayload(r); skip {
+		return err
+	}
+	v, err := s.encodeRequest(r)
+	if err != nil {
+		return err
+	}
+	key := s.getHostQueueID(host)
+	var n int64
+	err = s.doWrite("AddRequestForHost", func() (err error) {
+		n, err = addRequestCappedScript.Run(s.Context, s.queueClient(),
+			[]string{key}, s.MaxPerHostQueue, v).Int64()
+		return s.wrongKeyType(s.queueClient(), key, "list", err)
+	})
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrHostQueueFull
+	}
+	s.audit(AuditEnqueue, key)
+	return nil
+}
+
+// GetRequestForHost pops a request from the queue of host, see
+// AddRequestForHost. It returns redis.Nil if the queue is empty.
+func (s *Storage) GetRequestForHost(host string) ([]byte, error) {
+	return s.popDecoded("GetRequestForHost", s.getHostQueueID(host))
+}
+
+// popDecoded pops and decodes a request of the plain list key for op,
+// applying the UnmarshalErrorPolicy, see decodePopped.
+func (s *Storage) popDecoded(op, key string) ([]byte, error) {
+	var r []byte
+	err := s.doWrite(op, func() error {
+		for {
+			v, err := s.queueClient().RPop(s.Context, key).Bytes()
+			if err != nil {
+				return s.wrongKeyType(s.queueClient(), key, "list", err)
+			}
+			var retry bool
+			r, retry, err = s.decodePopped(op, v)
+			if !retry {
+				return err
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// RemoveRequest removes every queued occurrence of the request r, e.g. to
+// cancel it, and returns how many were removed. r is the payload as passed
+// to AddRequest; it is compressed like AddRequest does to match the stored
+// form, and with a Compressor the uncompressed form is removed as well.
+// Requests compressed by one of the Decompressors are not matched. With
+// PriorityHeader the copies pushed by AddRequestWithPriority are removed too,
+// by a script reading the whole queue, so it blocks redis for O(N).
+func (s *Storage) RemoveRequest(r []byte) (removed int, err error) {
+	v, err := s.encodeRequest(r)
+	if err != nil {
+		return 0, err
+	}
+	key := s.getQueueID()
+	err = s.doWrite("RemoveRequest", func() error {
+		if s.PriorityHeader {
+			forms := [][]byte{v}
+			if s.Compressor != nil {
+				forms = append(forms, r)
+			}
+			n, err := s.removeStored(s.ageKeys(key), 0, forms...)
+			if err != nil {
+				return s.wrongKeyTypes(s.queueClient(), err, s.queueKeyTypes(key)...)
+			}
+			removed = int(n)
+			return s.trimMirror(key)
+		}
+		pipe := s.queueClient().Pipeline()
+		cmds := []*redis.IntCmd{pipe.LRem(s.Context, key, 0, v)}
+		if s.Compressor != nil {
+			cmds = append(cmds, pipe.LRem(s.Context, key, 0, r))
+		}
+		if s.TrackQueueAge {
+			pipe.ZRem(s.Context, s.getQueueAgesID(), v, r)
+		}
+		_, err := pipe.Exec(s.Context)
+		if err != nil {
+			return s.wrongKeyTypes(s.queueClient(), err, s.queueKeyTypes(key)...)
+		}
+		for _, cmd := range cmds {
+			removed += int(cmd.Val())
+		}
+		return s.trimMirror(key)
+	})
+	return removed, err
+}
+
+// CountQueueMatching counts the queued requests for which match returns
+// true, e.g. how many product pages are pending. The queue is read in pages,
+// so it is O(N) in the queue length and meant for occasional monitoring, not
+// for hot paths. Concurrent pushes and pops make the count approximate.
+func (s *Storage) CountQueueMatching(match func([]byte) bool) (int, error) {
+	count := 0
+	err := s.do("CountQueueMatching", func() error {
+		count = 0
+		key := s.getQueueID()
+		for start := int64(0); ; start += pageSize {
+			items, err := s.queueClient().LRange(s.Context, key, start, start+pageSize-1).Result()
+			if err != nil {
+				return s.wrongKeyType(s.queueClient(), key, "list", err)
+			}
+			for _, item := range items {
+				r, err := s.decodeRequest([]byte(item))
+				if err == nil && match(r) {
+					count++
+				}
+			}
+			if len(items) < pageSize {
+				return nil
+			}
+		}
+	})
+	if err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// QuarantineHost moves all queued requests for host out of the queue to the
+// "<prefix>:quarantine:<host>" list, so workers stop hitting a host which is
+// down or blocking, and returns how many were moved. The host is read from
+// the URL of the queued colly requests, so entries which are not encoded
+// colly requests stay in the queue. The queue of AddRequestForHost is moved
+// as a whole to "<prefix>:quarantine:host:<host>".
+//
+// The queue is read in pages, so it is O(N) in the queue length. Requests
+// pushed or removed meanwhile shift the pages, so the scan can miss entries;
+// call it again to catch them.
+func (s *Storage) QuarantineHost(host string) (int, error) {
+	moved := 0
+	err := s.doWrite("QuarantineHost", func() error {
+		moved = 0
+		key := s.getQueueID()
+		keys := s.ageKeys(key, s.getQuarantineID(host))
+		var start int64
+		for {
+			items, err := s.queueClient().LRange(s.Context, key, start, start+pageSize-1).Result()
+			if err != nil {
+				return err
+			}
+			var match []interface{}
+			for _, item := range items {
+				r, err := s.decodeRequest([]byte(item))
+				if err != nil {
+					continue
+				}
+				h, err := requestHost(r)
+				if err == nil && strings.EqualFold(h, host) {
+					match = append(match, item)
+				}
+			}
+			var n int64
+			if len(match) > 0 {
+				n, err = moveRequestsScript.Run(s.Context, s.queueClient(), keys, match...).Int64()
+				if err != nil {
+					return err
+				}
+				moved += int(n)
+			}
+			if len(items) < pageSize {
+				break
+			}
+			start += pageSize - n
+		}
+		if moved > 0 {
+			err := s.trimMirror(key)
+			if err != nil {
+				return err
+			}
+		}
+		n, err := moveListScript.Run(s.Context, s.queueClient(),
+			[]string{s.getHostQueueID(host), s.getHostQuarantineID(host)}, "0").Int64()
+		moved += int(n)
+		return err
+	})
+	return moved, err
+}
+
+// ReleaseHost moves the requests quarantined by QuarantineHost back to the
+// queue, and those of the host queue back to it ahead of its new requests,
+// and returns how many were moved.
+func (s *Storage) ReleaseHost(host string) (int, error) {
+	var n, m int64
+	err := s.doWrite("ReleaseHost", func() (err error) {
+		args, err := s.mirrorSummaries(s.getQuarantineID(host))
+		if err != nil {
+			return err
+		}
+		n, err = releaseRequestsScript.Run(s.Context, s.queueClient(),
+			s.mirrorKeys(s.getQuarantineID(host), s.getQueueID()), args...).Int64()
+		if err != nil {
+			return err
+		}
+		m, err = moveListScript.Run(s.Context, s.queueClient(),
+			[]string{s.getHostQuarantineID(host), s.getHostQueueID(host)}, "1").Int64()
+		return err
+	})
+	return int(n + m), err
+}
+
+// CompactQueue removes queued requests which are already visited, and returns
+// how many entries were removed. It needs the RequestID func to identify the
+// entries; entries it cannot identify are kept.
+//
+// The queue is read in pages and the visited state is checked with one
+// pipeline per page, but it is still O(N) in the queue length, so it is best
+// run periodically in low-activity windows. Requests pushed concurrently may
+// be checked twice or not at all, which is harmless.
+func (s *Storage) CompactQueue() (removed int, err error) {
+	if s.RequestID == nil {
+		return 0, errors.New("RequestID func is required to compact the queue")
+	}
+	err = s.doWrite("CompactQueue", func() error {
+		removed, err = s.compactQueue()
+		if err != nil || removed == 0 {
+			return err
+		}
+		return s.trimMirror(s.getQueueID())
+	})
+	return removed, err
+}
+
+func (s *Storage) compactQueue() (removed int, err error) {
+	key := s.getQueueID()
+	var start int64
+	for {
+		items, err := s.queueClient().LRange(s.Context, key, start, start+pageSize-1).Result()
+		if err != nil {
+			return removed, err
+		}
+		if len(items) == 0 {
+			return removed, nil
+		}
+		pipe := s.visitedClient().Pipeline()
+		exists := make([]*redis.IntCmd, len(items))
+		for i, item := range items {
+			r, err := s.decodeRequest([]byte(item))
+			if err != nil {
+				continue
+			}
+			id, err := s.RequestID(r)
+			if err != nil {
+				continue
+			}
+			exists[i] = pipe.Exists(s.Context, s.getIDStr(id))
+		}
+		_, err = pipe.Exec(s.Context)
+		if err != nil {
+			return removed, err
+		}
+		pipe = s.queueClient().Pipeline()
+		var rems []*redis.IntCmd
+		for i, cmd := range exists {
+			if cmd != nil && cmd.Val() > 0 {
+				rems = append(rems, pipe.LRem(s.Context, key, 1, items[i]))
+				if s.TrackQueueAge {
+					pipe.ZRem(s.Context, s.getQueueAgesID(), items[i])
+				}
+			}
+		}
+		_, err = pipe.Exec(s.Context)
+		if err != nil {
+			return removed, err
+		}
+		var n int64
+		for _, cmd := range rems {
+			n += cmd.Val()
+		}
+		removed += int(n)
+		if len(items) < pageSize {
+			return removed, nil
+		}
+		start += pageSize - n
+	}
+}
+
+// peekAndLockScript locks the oldest request without a lock. The lock is a
+// hash holding the token and the payload, keyed by the sha1 of the payload.
+var peekAndLockScript = redis.NewScript(`
+local n = redis.call('LLEN', KEYS[1])
+for i = 1, n do
+	local v = redis.call('LINDEX', KEYS[1], -i)
+	if not v then
+		break
+	end
+	local sum = redis.sha1hex(v)
+	local lock = ARGV[1] .. sum
+	if redis.call('EXISTS', lock) == 0 then
+		local token = sum .. ':' .. ARGV[2]
+		redis.call('HSET', lock, 'token', token, 'payload', v)
+		redis.call('PEXPIRE', lock, ARGV[3])
+		return {token, v}
+	end
+end
+return false
+`)
+
+// commitPeekScript removes a locked request if the lock is still held,
+// see moveRequestsScript for KEYS[3]. It returns -1 if the lock is lost.
+var commitPeekScript = redis.NewScript(`
+if redis.call('HGET', KEYS[2], 'token') ~= ARGV[1] then
+	return -1
+end
+local v = redis.call('HGET', KEYS[2], 'payload')
+redis.call('DEL', KEYS[2])
+local n = redis.call('LREM', KEYS[1], -1, v)
+if n > 0 and KEYS[3] then
+	redis.call('ZREM', KEYS[3], v)
+end
+return n
+`)
+
+// PeekAndLock returns the next request which is not locked by another
+// PeekAndLock caller, without removing it from the queue, and locks it for
+// ttl. Pass the token to CommitPeek to remove the request once it is taken
+// for processing; if the worker crashes the lock simply expires and the
+// request becomes available again. Plain GetRequest ignores these locks.
+// It returns redis.Nil if every request is locked or the queue is empty.
+//
+// The script walks the queue from the tail with LINDEX, so it gets slower
+// with many locked requests at the front of the queue.
+func (s *Storage) PeekAndLock(ttl time.Duration) (token string, payload []byte, err error) {
+	id, err := newToken()
+	if err != nil {
+		return "", nil, err
+	}
+	var v interface{}
+	err = s.doWrite("PeekAndLock", func() (err error) {
+		v, err = peekAndLockScript.Run(s.Context, s.queueClient(), []string{s.getQueueID()},
+			s.getLockID(""), id, ttl.Milliseconds()).Result()
+		return s.wrongKeyType(s.queueClient(), s.getQueueID(), "list", err)
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	res := v.([]interface{})
+	payload, err = s.decodeRequest([]byte(res[1].(string)))
+	return res[0].(string), payload, err
+}
+
+// CommitPeek removes the request locked by PeekAndLock from the queue and
+// releases its lock. It returns ErrLockNotHeld if the lock already expired.
+func (s *Storage) CommitPeek(token string) error {
+	i := strings.IndexByte(token, ':')
+	if i < 0 {
+		return ErrLockNotHeld
+	}
+	var n int64
+	err := s.doWrite("CommitPeek", func() (err error) {
+		n, err = commitPeekScript.Run(s.Context, s.queueClient(),
+			s.ageKeys(s.getQueueID(), s.getLockID(token[:i])), token).Int64()
+		if err != nil || n <= 0 {
+			return err
+		}
+		return s.trimMirror(s.getQueueID())
+	})
+	if err != nil {
+		return err
+	}
+	if n < 0 {
+		return ErrLockNotHeld
+	}
+	return nil
+}
+
+// newToken returns a random hex string.
+func newToken() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// QueuedRequest is the human readable form of a queued colly request.
+type QueuedRequest struct {
+	URL    string `json:"url"`
+	Method string `json:"method"`
+}
+
+// DecodeCollyRequest is the default RequestDecoder, for the JSON encoding
+// of colly.Request.Marshal.
+func DecodeCollyRequest(r []byte) (url, method string, err error) {
+	var req QueuedRequest
+	err = json.Unmarshal(r, &req)
+	if err != nil {
+		return "", "", err
+	}
+	return req.URL, req.Method, nil
+}
+
+// ListQueueRequests decodes the queued requests from start to stop with
+// RequestDecoder, to inspect a crawl. Indexes are those of LRANGE, the
+// newest request is at 0 and the next one popped at -1.
+func (s *Storage) ListQueueRequests(start, stop int) ([]QueuedRequest, error) {
+	var items []string
+	err := s.do("ListQueueRequests", func() (err error) {
+		items, err = s.queueClient().LRange(s.Context, s.getQueueID(), int64(start), int64(stop)).Result()
+		return s.wrongKeyType(s.queueClient(), s.getQueueID(), "list", err)
+	})
+	if err != nil {
+		return nil, err
+	}
+	reqs := make([]QueuedRequest, len(items))
+	for i, item := range items {
+		r, err := s.decodeRequest([]byte(item))
+		if err != nil {
+			return nil, err
+		}
+		reqs[i].URL, reqs[i].Method, err = s.RequestDecoder(r)
+		if err != nil {
+			return nil, fmt.Errorf("decoding queued request %d: %w", start+i, err)
+		}
+	}
+	return reqs, nil
+}
+
+// requestHost returns the host of a serialized colly request.
+func requestHost(r []byte) (string, error) {
+	var sum QueuedRequest
+	err := json.Unmarshal(r, &sum)
+	if err != nil {
+		return "", err
+	}
+	u, err := url.Parse(sum.URL)
+	if err != nil {
+		return "", err
+	}
+	return u.Host, nil
+}
+
+// summarizeRequest returns the JSON summary of a serialized colly request.
+// Fields it cannot decode are left empty.
+func summarizeRequest(r []byte) string {
+	var sum QueuedRequest
+	_ = json.Unmarshal(r, &sum)
+	b, _ := json.Marshal(sum)
+	return string(b)
+}
@@ -0,0 +1,243 @@
+package collyredis
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+func TestEmptyPayloadPolicy(t *testing.T) {
+	payloads := map[string][]byte{
+		"nil":        nil,
+		"empty":      {},
+		"whitespace": []byte(" \t\r\n"),
+	}
+	for name, r := range payloads {
+		t.Run(name+" rejected", func(t *testing.T) {
+			s, _ := newTestStorage(t)
+			if err := s.Init(); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.AddRequest(r); err != ErrEmptyPayload {
+				t.Fatalf("AddRequest() = %v, want ErrEmptyPayload", err)
+			}
+			if n, _ := s.QueueSize(); n != 0 {
+				t.Fatalf("QueueSize() = %d, want 0", n)
+			}
+		})
+		t.Run(name+" skipped", func(t *testing.T) {
+			s, _ := newTestStorage(t)
+			s.EmptyPayloadPolicy = SkipEmptyPayload
+			if err := s.Init(); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.AddRequest(r); err != nil {
+				t.Fatalf("AddRequest() = %v, want nil", err)
+			}
+			if n, _ := s.QueueSize(); n != 0 {
+				t.Fatalf("QueueSize() = %d, want 0", n)
+			}
+		})
+	}
+}
+
+func TestAddRequestsDedupEmptyPayload(t *testing.T) {
+	items := [][]byte{[]byte("a"), []byte(" "), []byte("b")}
+
+	s, _ := newTestStorage(t)
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.AddRequestsDedup(items); err != ErrEmptyPayload {
+		t.Fatalf("AddRequestsDedup() = %v, want ErrEmptyPayload", err)
+	}
+	if n, _ := s.QueueSize(); n != 0 {
+		t.Fatalf("QueueSize() = %d, want 0, the batch must be aborted", n)
+	}
+
+	s.EmptyPayloadPolicy = SkipEmptyPayload
+	added, err := s.AddRequestsDedup(items)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []bool{true, false, true}; !reflect.DeepEqual(added, want) {
+		t.Fatalf("AddRequestsDedup() = %v, want %v", added, want)
+	}
+	if n, _ := s.QueueSize(); n != 2 {
+		t.Fatalf("QueueSize() = %d, want 2", n)
+	}
+}
+
+func TestQueueAgesRemoved(t *testing.T) {
+	req := func(host string) []byte {
+		return []byte(`{"url":"http://` + host + `/","method":"GET"}`)
+	}
+	tests := []struct {
+		name   string
+		remove func(s *Storage) error
+	}{
+		{"GetRequest", func(s *Storage) error {
+			_, err := s.GetRequest()
+			return err
+		}},
+		{"GetRequestIsLast", func(s *Storage) error {
+			_, _, err := s.GetRequestIsLast()
+			return err
+		}},
+		{"CommitPeek", func(s *Storage) error {
+			token, _, err := s.PeekAndLock(time.Minute)
+			if err != nil {
+				return err
+			}
+			return s.CommitPeek(token)
+		}},
+		{"CompactQueue", func(s *Storage) error {
+			s.RequestID = func([]byte) (uint64, error) { return 1, nil }
+			if err := s.Visited(1); err != nil {
+				return err
+			}
+			_, err := s.CompactQueue()
+			return err
+		}},
+		{"RemoveRequest", func(s *Storage) error {
+			_, err := s.RemoveRequest(req("a"))
+			return err
+		}},
+		{"QuarantineHost", func(s *Storage) error {
+			_, err := s.QuarantineHost("a")
+			return err
+		}},
+		{"GetRequestInFlight", func(s *Storage) error {
+			_, err := s.GetRequestInFlight("w")
+			return err
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, m := newTestStorage(t)
+			s.TrackQueueAge = true
+			if err := s.Init(); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.AddRequest(req("a")); err != nil {
+				t.Fatal(err)
+			}
+			if err := tt.remove(s); err != nil {
+				t.Fatal(err)
+			}
+			if n, _ := s.QueueSize(); n != 0 {
+				t.Fatalf("QueueSize() = %d, want 0", n)
+			}
+			if m.Exists(s.getQueueAgesID()) {
+				members, _ := m.ZMembers(s.getQueueAgesID())
+				t.Fatalf("queue ages still hold %q", members)
+			}
+		})
+	}
+}
+
+func TestQuarantineHostQueue(t *testing.T) {
+	s, _ := newTestStorage(t)
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range []string{"a", "b"} {
+		if err := s.AddRequestForHost("example.com", []byte(r)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.AddRequest([]byte(`{"URL":"http://example.com/c"}`)); err != nil {
+		t.Fatal(err)
+	}
+	moved, err := s.QuarantineHost("example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if moved != 3 {
+		t.Fatalf("QuarantineHost() = %d, want 3", moved)
+	}
+	if _, err := s.GetRequestForHost("example.com"); err != redis.Nil {
+		t.Fatalf("GetRequestForHost() error = %v, want redis.Nil", err)
+	}
+	// a request queued for the host while it is quarantined
+	if err := s.AddRequestForHost("example.com", []byte("d")); err != nil {
+		t.Fatal(err)
+	}
+	released, err := s.ReleaseHost("example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if released != 3 {
+		t.Fatalf("ReleaseHost() = %d, want 3", released)
+	}
+	var got []string
+	for {
+		r, err := s.GetRequestForHost("example.com")
+		if err == redis.Nil {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, string(r))
+	}
+	if want := []string{"a", "b", "d"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("host queue = %q, want %q", got, want)
+	}
+	if n, _ := s.QueueSize(); n != 1 {
+		t.Fatalf("QueueSize() = %d, want 1", n)
+	}
+}
+
+func TestPopsDeadLetterUndecodable(t *testing.T) {
+	pops := []struct {
+		name string
+		key  func(s *Storage) string
+		pop  func(s *Storage) ([]byte, error)
+	}{
+		{"GetRequestIsLast", (*Storage).getQueueID, func(s *Storage) ([]byte, error) {
+			r, _, err := s.GetRequestIsLast()
+			return r, err
+		}},
+		{"GetRequestPartition", func(s *Storage) string { return s.getPartitionID(0) },
+			func(s *Storage) ([]byte, error) { return s.GetRequestPartition(0) }},
+		{"GetRequestForHost", func(s *Storage) string { return s.getHostQueueID("example.com") },
+			func(s *Storage) ([]byte, error) { return s.GetRequestForHost("example.com") }},
+	}
+	for _, p := range pops {
+		t.Run(p.name, func(t *testing.T) {
+			s, _ := newTestStorage(t)
+			s.Compressor = GzipCompressor{}
+			s.Partitions = 1
+			s.UnmarshalErrorPolicy = DeadLetterUnmarshalError
+			if err := s.Init(); err != nil {
+				t.Fatal(err)
+			}
+			good, err := s.encodeRequest([]byte("a"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			bad := []byte{GzipCompressor{}.Tag(), 'x'}
+			// the bad entry is popped first
+			if err := s.Client.LPush(s.Context, p.key(s), bad, good).Err(); err != nil {
+				t.Fatal(err)
+			}
+			r, err := p.pop(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(r) != "a" {
+				t.Fatalf("%s() = %q, want \"a\"", p.name, r)
+			}
+			n, err := s.Client.LLen(s.Context, s.getDeadLetterID()).Result()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != 1 {
+				t.Fatalf("%d dead letters, want 1", n)
+			}
+		})
+	}
+}
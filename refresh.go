@@ -0,0 +1,97 @@
+package collyredis
+
+import (
+	"sync"
+	"time"
+)
+
+// refreshBuffer collects the visited keys waiting for a TTL renewal.
+type refreshBuffer struct {
+	mu   sync.Mutex
+	keys map[string]struct{}
+}
+
+func newRefreshBuffer() *refreshBuffer {
+	return &refreshBuffer{keys: make(map[string]struct{})}
+}
+
+func (b *refreshBuffer) add(key string) {
+	b.mu.Lock()
+	b.keys[key] = struct{}{}
+	b.mu.Unlock()
+}
+
+// take returns the buffered keys and empties the buffer.
+func (b *refreshBuffer) take() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	keys := make([]string, 0, len(b.keys))
+	for key := range b.keys {
+		keys = append(keys, key)
+	}
+	b.keys = make(map[string]struct{})
+	return keys
+}
+
+// refreshNow reports whether IsVisited renews a found key immediately.
+func (s *Storage) refreshNow() bool {
+	return s.RefreshOnRead && s.Expires > 0 && s.refresh == nil
+}
+
+// refreshCached renews key after a hit of the visited cache, which
+// bypasses the renewal of the redis read.
+func (s *Storage) refreshCached(key string) error {
+	if s.refresh != nil && s.Expires > 0 {
+		s.refresh.add(key)
+		return nil
+	}
+	if !s.refreshNow() {
+		return nil
+	}
+	return s.doWrite("RefreshVisited", func() error {
+		return s.visitedClient().Expire(s.Context, key, s.Expires).Err()
+	})
+}
+
+// runRefresh flushes the refresh buffer every RefreshInterval until Close.
+func (s *Storage) runRefresh() {
+	ticker := time.NewTicker(s.RefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+		err := s.flushRefresh()
+		if err != nil {
+			s.Logger.Printf("flushRefresh() error %s", err)
+		}
+	}
+}
+
+// flushRefresh renews the TTL of the buffered keys, one pipeline per page.
+func (s *Storage) flushRefresh() error {
+	keys := s.refresh.take()
+	if len(keys) == 0 {
+		return nil
+	}
+	return s.doWrite("RefreshVisited", func() error {
+		for len(keys) > 0 {
+			n := len(keys)
+			if n > pageSize {
+				n = pageSize
+			}
+			pipe := s.visitedClient().Pipeline()
+			for _, key := range keys[:n] {
+				pipe.Expire(s.Context, key, s.Expires)
+			}
+			_, err := pipe.Exec(s.Context)
+			if err != nil {
+				return err
+			}
+			keys = keys[n:]
+		}
+		return nil
+	})
+}
@@ -0,0 +1,35 @@
+package collyredis
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRefreshOnReadCacheHit(t *testing.T) {
+	for _, interval := range []time.Duration{0, time.Hour} {
+		t.Run(interval.String(), func(t *testing.T) {
+			s, m := newTestStorage(t)
+			s.Expires = time.Minute
+			s.VisitedCacheSize = 10
+			s.RefreshOnRead = true
+			s.RefreshInterval = interval
+			if err := s.Init(); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.Visited(1); err != nil {
+				t.Fatal(err)
+			}
+			m.FastForward(30 * time.Second)
+			visited, err := s.IsVisited(1)
+			if err != nil || !visited {
+				t.Fatalf("IsVisited() = %v, %v", visited, err)
+			}
+			if err := s.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if ttl := m.TTL(s.getIDStr(1)); ttl != time.Minute {
+				t.Fatalf("TTL after a cache hit = %s, want %s", ttl, time.Minute)
+			}
+		})
+	}
+}
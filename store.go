@@ -6,31 +6,140 @@ import (
 	"fmt"
 	"log"
 	"net/url"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-redis/redis/v8"
 )
 
+// Logger is where the storage logs, e.g. a *log.Logger.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
 // RedisClient is because go-redis has many kind of clients.
 type RedisClient interface {
 	Ping(ctx context.Context) *redis.StatusCmd
+	Info(ctx context.Context, section ...string) *redis.StringCmd
 	Keys(ctx context.Context, pattern string) *redis.StringSliceCmd
+	Scan(ctx context.Context, cursor uint64, match string, count int64) *redis.ScanCmd
 	Get(ctx context.Context, key string) *redis.StringCmd
 	Set(ctx context.Context, key string, value interface{}, expiration time.Duration) *redis.StatusCmd
+	SetNX(ctx context.Context, key string, value interface{}, expiration time.Duration) *redis.BoolCmd
 	Del(ctx context.Context, keys ...string) *redis.IntCmd
 	Exists(ctx context.Context, keys ...string) *redis.IntCmd
 	Expire(ctx context.Context, key string, expiration time.Duration) *redis.BoolCmd
+	TTL(ctx context.Context, key string) *redis.DurationCmd
+	Incr(ctx context.Context, key string) *redis.IntCmd
+	Type(ctx context.Context, key string) *redis.StatusCmd
 	LPush(ctx context.Context, key string, values ...interface{}) *redis.IntCmd
 	RPop(ctx context.Context, key string) *redis.StringCmd
+	RPopLPush(ctx context.Context, source, destination string) *redis.StringCmd
 	LLen(ctx context.Context, key string) *redis.IntCmd
+	LRange(ctx context.Context, key string, start, stop int64) *redis.StringSliceCmd
+	LRem(ctx context.Context, key string, count int64, value interface{}) *redis.IntCmd
+	PFAdd(ctx context.Context, key string, els ...interface{}) *redis.IntCmd
+	PFCount(ctx context.Context, keys ...string) *redis.IntCmd
+	XAdd(ctx context.Context, a *redis.XAddArgs) *redis.StringCmd
+	Pipeline() redis.Pipeliner
+	TxPipelined(ctx context.Context, fn func(redis.Pipeliner) error) ([]redis.Cmder, error)
+	Eval(ctx context.Context, script string, keys []string, args ...interface{}) *redis.Cmd
+	EvalSha(ctx context.Context, sha1 string, keys []string, args ...interface{}) *redis.Cmd
+	ScriptExists(ctx context.Context, hashes ...string) *redis.BoolSliceCmd
+	ScriptLoad(ctx context.Context, script string) *redis.StringCmd
+	Time(ctx context.Context) *redis.TimeCmd
+	Do(ctx context.Context, args ...interface{}) *redis.Cmd
 }
 
+// ExistingDataPolicy decides what Init does when the prefix already holds
+// data of a previous crawl.
+type ExistingDataPolicy int
+
+const (
+	// ResumeExistingData keeps the data and continues the previous crawl.
+	ResumeExistingData ExistingDataPolicy = iota
+	// FailOnExistingData makes Init return ErrExistingData.
+	FailOnExistingData
+	// ClearExistingData clears the storage before it is used.
+	ClearExistingData
+)
+
+// ErrExistingData is returned by Init with FailOnExistingData.
+var ErrExistingData = errors.New("storage prefix already has data")
+
+// EmptyPayloadPolicy decides what happens to empty or whitespace-only
+// requests pushed to the queue, which are usually caused by upstream bugs.
+type EmptyPayloadPolicy int
+
+const (
+	// RejectEmptyPayload returns ErrEmptyPayload.
+	RejectEmptyPayload EmptyPayloadPolicy = iota
+	// SkipEmptyPayload silently drops the request.
+	SkipEmptyPayload
+)
+
+// ErrEmptyPayload is returned for empty requests with RejectEmptyPayload.
+var ErrEmptyPayload = errors.New("empty request payload")
+
+// UnmarshalErrorPolicy decides what GetRequest and the other pop methods do
+// with a popped request which cannot be decoded, e.g. by a Compressor.
+type UnmarshalErrorPolicy int
+
+const (
+	// ReturnUnmarshalError returns the error, the request is dropped.
+	ReturnUnmarshalError UnmarshalErrorPolicy = iota
+	// DeadLetterUnmarshalError pushes the raw stored value to the
+	// "<prefix>:deadletter" list and pops the next request.
+	DeadLetterUnmarshalError
+)
+
 // Storage implements the redis storage backend for Colly
 type Storage struct {
 	// Client any kind of [go-redis](https://github.com/go-redis/redis) client
 	Client RedisClient
 
+	// MaxRetries is how many times an operation is retried after a connection
+	// error, zero disables retries. This is on top of the retries of the
+	// go-redis client itself. A retried write may be applied twice when the
+	// connection broke after redis executed it, e.g. a duplicated LPUSH.
+	MaxRetries int
+
+	// RetryBackoff is the wait before the first retry, doubled for every
+	// further one. Defaults to 100 milliseconds.
+	RetryBackoff time.Duration
+
+	// OnRetry is called before every retry with the operation name,
+	// the attempt number starting at 1 and the error that caused it.
+	OnRetry func(op string, attempt int, err error)
+
+	// FallbackClient is an optional secondary redis. After FailoverThreshold
+	// consecutive connection errors Client is replaced by FallbackClient,
+	// and Client is probed every FailoverProbeInterval to switch back.
+	// The two are independent instances, so data written during a failover
+	// stays on the fallback, and visited state or queued requests of one are
+	// not seen on the other. The keyspace clients below never fail over.
+	FallbackClient RedisClient
+
+	// FailoverThreshold defaults to 3 consecutive connection errors of
+	// commands run on Client, retries included. Errors of the keyspace
+	// clients are not counted. The commands are observed with a go-redis
+	// hook; a Client without AddHook is observed per operation instead,
+	// which only works while no keyspace client is set.
+	FailoverThreshold int
+
+	// FailoverProbeInterval defaults to 10 seconds.
+	FailoverProbeInterval time.Duration
+
+	// VisitedClient, CookieClient and QueueClient optionally route a single
+	// keyspace to its own client, e.g. each one configured with another DB
+	// for isolation and separate FLUSHDB control. Unset ones fall back to
+	// Client. Every distinct client keeps its own connection pool.
+	VisitedClient RedisClient
+	CookieClient  RedisClient
+	QueueClient   RedisClient
+
 	// Prefix is an optional string in the keys. It can be used
 	// to use one redis database for independent scraping tasks.
 	Prefix string
@@ -39,10 +148,218 @@ type Storage struct {
 	// are to be visited again.
 	Expires time.Duration
 
+	// VisitedCacheSize enables an in-process LRU cache of request IDs known
+	// to be visited, so repeated IsVisited calls for hot URLs skip redis.
+	// Only positive results are cached. Zero disables the cache.
+	VisitedCacheSize int
+
+	// VisitedCacheTTL is how long a cached visited result is trusted.
+	// It is capped to Expires, zero means until evicted (or Expires).
+	VisitedCacheTTL time.Duration
+
+	// DebugQueue mirrors a JSON summary (URL and method) of every queued
+	// request into the "<prefix>:queue:debug" list, so the queue can be read
+	// in redis-cli. It doubles the queue writes, so leave it off in
+	// production. The pushes, pops, rotations and releases of the queue
+	// keep the mirror at the same index. RemoveRequest, CompactQueue,
+	// QuarantineHost and CommitPeek remove from the middle of the queue and
+	// only trim the mirror to its length, which can shift it; the mirror
+	// is not written by AddRequestDebounced and AddRequestsDedup.
+	DebugQueue bool
+
+	// Partitions is the number of partitioned queues used by
+	// AddRequestPartitioned and GetRequestPartition.
+	Partitions int
+
+	// QueueGenerations enables NewQueueGeneration. The active generation
+	// is read by Init, and then polled every GenerationPollInterval (default
+	// one second), so other workers move to a new generation within that
+	// interval. Partitioned queues are not affected by generations.
+	QueueGenerations bool
+
+	// GenerationPollInterval defaults to one second.
+	GenerationPollInterval time.Duration
+
+	// TrackQueueAge records the enqueue time of every request pushed by
+	// AddRequest in the "<prefix>:queue:ages" sorted set, which is needed by
+	// QueueAgeHistogram. Identical payloads share a single timestamp.
+	// Every method taking requests out of the queue removes them from it.
+	TrackQueueAge bool
+
+	// Compressor optionally compresses queued requests. Every compressed
+	// payload starts with the tag byte of its Compressor; payloads without a
+	// known tag are read as they are.
+	Compressor Compressor
+
+	// Decompressors are additional Compressors recognised by tag when
+	// reading the queue, e.g. the previous algorithm during a migration.
+	Decompressors []Compressor
+
+	// EmptyPayloadPolicy defaults to RejectEmptyPayload.
+	EmptyPayloadPolicy EmptyPayloadPolicy
+
+	// HighWatermark and LowWatermark are queue sizes at which AddRequest and
+	// GetRequest, and their priority and GetRequestIsLast variants, call
+	// OnWatermarkCrossed: with "high" once the size reaches HighWatermark,
+	// then with "low" once it falls to LowWatermark, and so on. The gap
+	// between them keeps a size hovering around one of them from firing
+	// repeatedly. The callback runs synchronously without any lock held.
+	// Pops need one more LLEN round trip to learn the size.
+	HighWatermark      int
+	LowWatermark       int
+	OnWatermarkCrossed func(level string, size int)
+
+	// PriorityHeader enables AddRequestWithPriority, which stores a
+	// priority hint in a small header in front of the request.
+	PriorityHeader bool
+
+	// UnmarshalErrorPolicy defaults to ReturnUnmarshalError.
+	UnmarshalErrorPolicy UnmarshalErrorPolicy
+
+	// MaxPerHostQueue caps the requests queued per host by
+	// AddRequestForHost. Zero is unlimited.
+	MaxPerHostQueue int
+
+	// MaxProcessAttempts is how many failed attempts FailRequest allows
+	// before dead-lettering a request. Zero never dead-letters.
+	MaxProcessAttempts int
+
+	// RequestID extracts the colly request ID from a queued payload.
+	// It is only needed by CompactQueue.
+	RequestID func(r []byte) (uint64, error)
+
+	// RequestDecoder extracts the URL and method from a queued payload for
+	// ListQueueRequests, defaults to DecodeCollyRequest.
+	RequestDecoder func(r []byte) (url, method string, err error)
+
+	// RefreshOnRead renews the Expires of a visited key whenever IsVisited
+	// finds it, so pages which are referenced often are not visited again.
+	// This includes hits of the visited cache, so with VisitedCacheSize a
+	// RefreshInterval saves the EXPIRE round trip the cache was meant to.
+	RefreshOnRead bool
+
+	// RefreshInterval batches the renewals of RefreshOnRead: keys are
+	// collected and renewed with pipelined EXPIREs every interval, and on
+	// Close. A key may expire in that window before its renewal lands.
+	// Zero renews immediately with one EXPIRE per positive IsVisited.
+	RefreshInterval time.Duration
+
+	// CoalesceReads batches IsVisited calls arriving while another one is
+	// in flight into one pipeline of TYPE, sent when that read returns or
+	// after at most CoalesceWindow, for far fewer round trips under bursty
+	// concurrent reads. Every caller still gets its own result, and a call
+	// while no other read is running goes out at once, so sequential calls
+	// are not slowed down.
+	CoalesceReads bool
+
+	// CoalesceWindow is the longest a read waits for its batch, defaults
+	// to one millisecond.
+	CoalesceWindow time.Duration
+
+	// MaxVisited is an optional hard cap on the number of distinct visited
+	// requests of the crawl. Visited counts new requests atomically and
+	// returns ErrVisitedCapReached once the cap is reached; requests that
+	// are already visited can still be marked. The count is not decreased by
+	// Unvisit or expiry.
+	MaxVisited int
+
+	// CapReachedIsVisited makes IsVisited report new requests as visited
+	// once MaxVisited is reached, so colly stops crawling.
+	CapReachedIsVisited bool
+
+	// CountVisited additionally adds every visited request to a HyperLogLog,
+	// so VisitedCount can estimate the number of visited requests cheaply.
+	CountVisited bool
+
+	// ClearExclusive makes the writes of this storage (visited marks,
+	// cookies and queue pushes and pops) wait while Clear is running, so a
+	// worker cannot re-seed keys half way through. Clear sets the
+	// "<prefix>:clearing" flag, which the writes of every process using
+	// ClearExclusive poll, and releases it when it returns, also on error.
+	// A write already sent when the flag is set can still land, and Clear
+	// waits 100ms after setting it for the other processes to notice. Within
+	// one process Clear also waits for the running writes before it starts.
+	ClearExclusive bool
+
+	// ClearFlagTTL expires the clearing flag of ClearExclusive in case the
+	// process running Clear dies, so the writes are not held back forever.
+	// It should exceed the longest Clear and defaults to one minute.
+	ClearFlagTTL time.Duration
+
+	// MaxConcurrency bounds how many storage operations run at the same
+	// time, so extreme parallelism waits for a slot (or the Context to be
+	// done) instead of exhausting the connection pool. Zero disables it.
+	MaxConcurrency int
+
+	// CrawlTTL is an optional maximum lifetime of the whole crawl. The start
+	// of the crawl is recorded in redis by the first Init, and once CrawlTTL
+	// has passed since then the storage is cleared by a background task,
+	// whatever the TTLs of the single keys are. After a Clear of another
+	// kind the task records a new start. Close stops the task.
+	CrawlTTL time.Duration
+
+	// OnExistingData is checked by Init, defaults to ResumeExistingData.
+	OnExistingData ExistingDataPolicy
+
+	// OnMissingFeature is checked by Init, defaults to FailOnMissingFeature.
+	OnMissingFeature MissingFeaturePolicy
+
+	// Logger defaults to the standard logger.
+	Logger Logger
+
+	// Debug logs the key and TTL of every visited and cookie write to
+	// Logger, to diagnose unexpected expirations.
+	Debug bool
+
 	// Context can be used for canceling all redis request, if you supply your own.
 	Context context.Context
 
-	mu sync.RWMutex // Only used for cookie methods.
+	// HostNormalizer maps the host of a cookie key, so variants like
+	// "www.example.com" and "EXAMPLE.COM:443" can share their cookies.
+	// Nil uses the host as is. ExportCookies returns the normalized hosts,
+	// and ImportCookies normalizes its hosts, so variants merge there too.
+	HostNormalizer func(host string) string
+
+	// CookieExpires is an optional expiration time for the cookies of a
+	// host, renewed whenever they are set. Zero keeps them forever.
+	CookieExpires time.Duration
+
+	// AuditLog is an optional recorder for every successful mutating
+	// operation (visited, unvisit, enqueue, cookie set, clear). Nil disables auditing.
+	AuditLog AuditLog
+
+	// CookieFormat is an optional encoding for cookies on write.
+	// Nil stores the raw cookie string, as before.
+	CookieFormat CookieFormat
+
+	// CookieFormats are additional formats recognised by magic prefix when
+	// reading cookies, e.g. values still written by older or newer writers.
+	// See CookieFormat for the detection scheme.
+	CookieFormats []CookieFormat
+
+	// CookieLockStripes is how many locks the cookie methods are striped
+	// across by host, defaults to 64. Writes of one host are serialized,
+	// different hosts only contend when they share a stripe.
+	CookieLockStripes int
+
+	cookieLocks cookieLocks  // Only used for cookie methods.
+	clearMu     sync.RWMutex // Only used with ClearExclusive.
+
+	clearChecked atomic.Value // time.Time
+
+	visitedCache *visitedCache
+	sem          chan struct{}
+	inFlight     int32
+	failover     failover
+	errorWindow  errorWindow
+	generation   int32
+	aboveHigh    int32
+	refresh      *refreshBuffer
+	coalescer    *readCoalescer
+	done         chan struct{}
+	closeOnce    sync.Once
+	metrics      atomic.Value // *promCollector
+	promOnce     sync.Once
 }
 
 // Init initializes the redis storage
@@ -53,49 +370,312 @@ func (s *Storage) Init() error {
 	if s.Context == nil {
 		s.Context = context.Background()
 	}
+	if s.Logger == nil {
+		s.Logger = log.Default()
+	}
+	if s.RequestDecoder == nil {
+		s.RequestDecoder = DecodeCollyRequest
+	}
 	if s.Client == nil {
 		return errors.New("redis client not found")
 	}
-	err := s.Client.Ping(s.Context).Err()
+	if s.VisitedCacheSize > 0 {
+		ttl := s.VisitedCacheTTL
+		if s.Expires > 0 && (ttl <= 0 || ttl > s.Expires) {
+			ttl = s.Expires
+		}
+		s.visitedCache = newVisitedCache(s.VisitedCacheSize, ttl)
+	}
+	if s.CoalesceReads {
+		if s.CoalesceWindow <= 0 {
+			s.CoalesceWindow = time.Millisecond
+		}
+		s.coalescer = &readCoalescer{s: s}
+	}
+	if s.MaxConcurrency > 0 {
+		s.sem = make(chan struct{}, s.MaxConcurrency)
+	}
+	if s.RetryBackoff <= 0 {
+		s.RetryBackoff = 100 * time.Millisecond
+	}
+	if s.ClearFlagTTL <= 0 {
+		s.ClearFlagTTL = time.Minute
+	}
+	if s.FailoverThreshold <= 0 {
+		s.FailoverThreshold = 3
+	}
+	if s.FailoverProbeInterval <= 0 {
+		s.FailoverProbeInterval = 10 * time.Second
+	}
+	s.watchPrimary()
+	if s.CookieLockStripes <= 0 {
+		s.CookieLockStripes = 64
+	}
+	s.cookieLocks = make(cookieLocks, s.CookieLockStripes)
+	s.done = make(chan struct{})
+	for _, c := range s.clients() {
+		err := c.Ping(s.Context).Err()
+		if err != nil {
+			return fmt.Errorf("redis connection error: %w", err)
+		}
+	}
+	err := s.checkFeatures()
 	if err != nil {
-		return fmt.Errorf("redis connection error: %w", err)
+		return err
 	}
-	return err
+	err = s.checkExistingData()
+	if err != nil {
+		return err
+	}
+	if s.QueueGenerations {
+		if s.GenerationPollInterval <= 0 {
+			s.GenerationPollInterval = time.Second
+		}
+		// the type check needs the active generation
+		err = s.loadGeneration()
+		if err != nil {
+			return err
+		}
+	}
+	err = s.checkQueueType()
+	if err != nil {
+		return err
+	}
+	if s.CrawlTTL > 0 {
+		err = s.startCrawl()
+		if err != nil {
+			return err
+		}
+		go s.runCrawlTTL()
+	}
+	if s.QueueGenerations {
+		go s.pollGeneration()
+	}
+	if s.RefreshOnRead && s.RefreshInterval > 0 {
+		s.refresh = newRefreshBuffer()
+		go s.runRefresh()
+	}
+	return nil
 }
 
-// Clear removes all entries from the storage
-func (s *Storage) Clear() error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	keys, err := s.Client.Keys(s.Context, s.getCookieID("*")).Result()
+// checkExistingData applies OnExistingData.
+func (s *Storage) checkExistingData() error {
+	if s.OnExistingData == ResumeExistingData {
+		return nil
+	}
+	found, err := s.hasData()
+	if err != nil || !found {
+		return err
+	}
+	if s.OnExistingData == FailOnExistingData {
+		return ErrExistingData
+	}
+	return s.Clear()
+}
+
+// Close stops the background tasks of the storage.
+// It does not close the redis clients.
+func (s *Storage) Close() error {
+	s.closeOnce.Do(func() {
+		if s.done != nil {
+			close(s.done)
+		}
+	})
+	if s.refresh != nil {
+		return s.flushRefresh()
+	}
+	return nil
+}
+
+// checkQueueType detects the redis type of an existing queue, so a queue
+// left in another form by a previous run is not used with list commands.
+// The list is the only queue backend, so any other type is an error.
+func (s *Storage) checkQueueType() error {
+	key := s.getQueueID()
+	typ, err := s.queueClient().Type(s.Context, key).Result()
 	if err != nil {
 		return err
 	}
-	keys2, err := s.Client.Keys(s.Context, s.Prefix+":request:*").Result()
+	switch typ {
+	case "none":
+		return nil
+	case "list":
+		s.Logger.Printf("resuming queue %s with the list backend", key)
+		return nil
+	}
+	return &ErrWrongKeyType{Key: key, Expected: "list", Actual: typ}
+}
+
+// hasData probes for existing keys under the prefix with a bounded SCAN,
+// so it may miss data in a very large database. The audit stream is not
+// crawl data and is ignored, and so are the keys of longer prefixes.
+func (s *Storage) hasData() (bool, error) {
+	for _, c := range s.clients() {
+		var cursor uint64
+		for i := 0; i < 100; i++ {
+			keys, next, err := c.Scan(s.Context, cursor, s.Prefix+":*", 1000).Result()
+			if err != nil {
+				return false, err
+			}
+			for _, key := range keys {
+				if s.ownsKey(key) && key != s.Prefix+":audit" && key != s.getClearingID() {
+					return true, nil
+				}
+			}
+			if next == 0 {
+				break
+			}
+			cursor = next
+		}
+	}
+	return false, nil
+}
+
+// Clear removes all entries from the storage
+func (s *Storage) Clear() error {
+	defer s.cookieLocks.lock()()
+	if s.ClearExclusive {
+		s.clearMu.Lock()
+		defer s.clearMu.Unlock()
+		release, err := s.holdClearing()
+		if err != nil {
+			return err
+		}
+		defer release()
+	}
+	err := s.do("Clear", func() error {
+		err := s.deleteKeys(s.client(), []string{s.getCrawlStartID(), s.getProgressID(), s.getLeaderID()})
+		if err != nil {
+			return err
+		}
+		err = s.deleteKeys(s.cookieClient(), nil, s.getCookiePrefix()+"*")
+		if err != nil {
+			return err
+		}
+		err = s.deleteKeys(s.visitedClient(), []string{s.getVisitedCountID(), s.getVisitedCapID()}, s.Prefix+":request:*")
+		if err != nil {
+			return err
+		}
+		keys := []string{s.getGenerationQueueID(0), s.getGenerationID(), s.getQueueDebugID(), s.getQueueAgesID(),
+			s.getQueueSeenID(), s.getAttemptsID(), s.getDeadLetterID()}
+		for p := 0; p < s.Partitions; p++ {
+			keys = append(keys, s.getPartitionID(p))
+		}
+		return s.deleteKeys(s.queueClient(), keys, s.getLockID("*"), s.Prefix+":debounce:*", s.Prefix+":queue:gen[0-9]*",
+			s.getQuarantineID("*"), s.getHostQueueID("*"), s.getInFlightID("*"))
+	})
 	if err != nil {
 		return err
 	}
-	keys = append(keys, keys2...)
-	keys = append(keys, s.getQueueID())
-	return s.Client.Del(s.Context, keys...).Err()
+	// the generation counter was deleted
+	atomic.StoreInt32(&s.generation, 0)
+	if s.visitedCache != nil {
+		s.visitedCache.clear()
+	}
+	s.audit(AuditClear, s.Prefix)
+	return nil
 }
 
 // Visited implements colly/storage.Visited()
 func (s *Storage) Visited(requestID uint64) error {
-	return s.Client.Set(s.Context, s.getIDStr(requestID), "1", s.Expires).Err()
+	key := s.getIDStr(requestID)
+	err := s.doWrite("Visited", func() error {
+		var err error
+		if s.MaxVisited > 0 {
+			err = s.markVisitedCapped([]uint64{requestID})
+		} else {
+			err = s.visitedClient().Set(s.Context, key, "1", s.Expires).Err()
+		}
+		if err != nil || !s.CountVisited {
+			return err
+		}
+		err = s.visitedClient().PFAdd(s.Context, s.getVisitedCountID(), requestID).Err()
+		return s.wrongKeyType(s.visitedClient(), s.getVisitedCountID(), "string", err)
+	})
+	if err != nil {
+		return err
+	}
+	if s.visitedCache != nil {
+		s.visitedCache.add(requestID)
+	}
+	s.debugTTL("Visited", key, s.Expires)
+	s.audit(AuditVisited, key)
+	return nil
 }
 
 // IsVisited implements colly/storage.IsVisited()
 func (s *Storage) IsVisited(requestID uint64) (bool, error) {
-	err := s.Client.Get(s.Context, s.getIDStr(requestID)).Err()
-	if err == redis.Nil {
-		return false, nil
-	} else if err != nil {
+	key := s.getIDStr(requestID)
+	if s.visitedCache != nil && s.visitedCache.get(requestID) {
+		return true, s.refreshCached(key)
+	}
+	var visited bool
+	var err error
+	if s.coalescer != nil {
+		visited, err = s.coalescer.isVisited(requestID)
+	} else {
+		err = s.do("IsVisited", func() error {
+			err := s.visitedClient().Get(s.Context, key).Err()
+			if err != nil || !s.refreshNow() {
+				return s.wrongKeyType(s.visitedClient(), key, "string", err)
+			}
+			return s.visitedClient().Expire(s.Context, key, s.Expires).Err()
+		})
+		visited = err == nil
+		if err == redis.Nil {
+			err = nil
+		}
+	}
+	if err != nil {
 		return false, err
 	}
+	if !visited {
+		if s.MaxVisited > 0 && s.CapReachedIsVisited {
+			return s.visitedCapReached()
+		}
+		return false, nil
+	}
+	if s.refresh != nil && s.Expires > 0 {
+		s.refresh.add(key)
+	}
+	if s.visitedCache != nil {
+		s.visitedCache.add(requestID)
+	}
 	return true, nil
 }
 
+// VisitedCount returns the estimated number of distinct visited requests.
+// It needs CountVisited. The count comes from a HyperLogLog, so it is
+// approximate (standard error of 0.81%), it is not decreased by Unvisit or
+// expiry, and it cannot answer whether a single request was visited.
+func (s *Storage) VisitedCount() (int64, error) {
+	if !s.CountVisited {
+		return 0, errors.New("visited counting is not enabled")
+	}
+	var n int64
+	err := s.do("VisitedCount", func() (err error) {
+		n, err = s.visitedClient().PFCount(s.Context, s.getVisitedCountID()).Result()
+		return err
+	})
+	return n, err
+}
+
+// Unvisit removes the visited mark of a request, so it can be visited again.
+func (s *Storage) Unvisit(requestID uint64) error {
+	key := s.getIDStr(requestID)
+	err := s.doWrite("Unvisit", func() error {
+		return s.visitedClient().Del(s.Context, key).Err()
+	})
+	if s.visitedCache != nil {
+		s.visitedCache.remove(requestID)
+	}
+	if err != nil {
+		return err
+	}
+	s.audit(AuditUnvisit, key)
+	return nil
+}
+
 // SetCookies implements colly/storage..SetCookies()
 func (s *Storage) SetCookies(u *url.URL, cookies string) {
 	// TODO(js) Cookie methods currently have no way to return an error.
@@ -104,28 +684,47 @@ func (s *Storage) SetCookies(u *url.URL, cookies string) {
 	// if two callers set cookies in a very small window of time,
 	// it is possible to drop the new cookies from one caller
 	// ('last update wins' == best avoided).
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	err := s.Client.Set(s.Context, s.getCookieID(u.Host), cookies, 0).Err()
+	key := s.getCookieID(u.Host)
+	defer s.cookieLocks.lock(key)()
+	value, err := s.encodeCookies(cookies)
+	if err != nil {
+		s.Logger.Printf("SetCookies() encode error %s", err)
+		return
+	}
+	err = s.doWrite("SetCookies", func() error {
+		return s.cookieClient().Set(s.Context, key, value, s.CookieExpires).Err()
+	})
 	if err != nil {
 		// return nil
-		log.Printf("SetCookies() .Set error %s", err)
+		s.Logger.Printf("SetCookies() .Set error %s", err)
 		return
 	}
+	s.debugTTL("SetCookies", key, s.CookieExpires)
+	s.audit(AuditCookie, key)
 }
 
 // Cookies implements colly/storage.Cookies()
 func (s *Storage) Cookies(u *url.URL) string {
 	// TODO(js) Cookie methods currently have no way to return an error.
 
-	s.mu.RLock()
-	cookiesStr, err := s.Client.Get(s.Context, s.getCookieID(u.Host)).Result()
-	s.mu.RUnlock()
+	var cookiesStr string
+	key := s.getCookieID(u.Host)
+	unlock := s.cookieLocks.rlock(key)
+	err := s.do("Cookies", func() (err error) {
+		cookiesStr, err = s.cookieClient().Get(s.Context, key).Result()
+		return s.wrongKeyType(s.cookieClient(), key, "string", err)
+	})
+	unlock()
 	if err == redis.Nil {
 		cookiesStr = ""
 	} else if err != nil {
 		// return nil, err
-		log.Printf("Cookies() .Get error %s", err)
+		s.Logger.Printf("Cookies() .Get error %s", err)
+		return ""
+	}
+	cookiesStr, err = s.decodeCookies(cookiesStr)
+	if err != nil {
+		s.Logger.Printf("Cookies() decode error %s", err)
 		return ""
 	}
 	return cookiesStr
@@ -133,32 +732,310 @@ func (s *Storage) Cookies(u *url.URL) string {
 
 // AddRequest implements queue.Storage.AddRequest() function
 func (s *Storage) AddRequest(r []byte) error {
-	return s.Client.LPush(s.Context, s.getQueueID(), r).Err()
+	if skip, err := s.checkPayload(r); skip {
+		return err
+	}
+	key := s.getQueueID()
+	size := int64(-1)
+	err := s.doWrite("AddRequest", func() (err error) {
+		size, err = s.pushRequest(key, r)
+		return s.wrongKeyTypes(s.queueClient(), err, s.queueKeyTypes(key)...)
+	})
+	if err != nil {
+		return err
+	}
+	s.observeWatermark(size)
+	s.audit(AuditEnqueue, key)
+	return nil
 }
 
 // GetRequest implements queue.Storage.GetRequest() function
 func (s *Storage) GetRequest() ([]byte, error) {
-	r, err := s.Client.RPop(s.Context, s.getQueueID()).Bytes()
+	r, _, err := s.getRequest("GetRequest")
+	return r, err
+}
+
+// getRequest pops and decodes a request for op, applying the
+// UnmarshalErrorPolicy and the watermarks, and returns its priority hint.
+func (s *Storage) getRequest(op string) (r []byte, priority byte, err error) {
+	key := s.getQueueID()
+	size := int64(-1)
+	err = s.doWrite(op, func() error {
+		for {
+			v, err := s.popRequest(key)
+			if err == redis.Nil {
+				size = 0
+			}
+			if err != nil {
+				return s.wrongKeyTypes(s.queueClient(), err, s.queueKeyTypes(key)...)
+			}
+			var retry bool
+			r, retry, err = s.decodePopped(op, v)
+			if retry {
+				continue
+			}
+			if err == nil {
+				priority, _ = s.splitPriority(v)
+				size = s.sizeAfterPop(key)
+			}
+			return err
+		}
+	})
+	s.observeWatermark(size)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
-	return r, err
+	return r, priority, nil
+}
+
+// decodePopped decodes the request v popped by op. With
+// DeadLetterUnmarshalError an undecodable v is pushed to the dead-letter
+// list instead, and retry reports that the caller should pop the next one.
+// It runs inside the operation of the pop.
+func (s *Storage) decodePopped(op string, v []byte) (r []byte, retry bool, err error) {
+	r, err = s.decodeRequest(v)
+	if err == nil || s.UnmarshalErrorPolicy != DeadLetterUnmarshalError {
+		return r, false, err
+	}
+	s.Logger.Printf("%s() decode error %s, dead-lettering", op, err)
+	err = s.queueClient().LPush(s.Context, s.getDeadLetterID(), v).Err()
+	if err != nil {
+		return nil, false, err
+	}
+	return nil, true, nil
 }
 
 // QueueSize implements queue.Storage.QueueSize() function
 func (s *Storage) QueueSize() (int, error) {
-	i, err := s.Client.LLen(s.Context, s.getQueueID()).Result()
+	var i int64
+	err := s.do("QueueSize", func() (err error) {
+		i, err = s.queueClient().LLen(s.Context, s.getQueueID()).Result()
+		return s.wrongKeyType(s.queueClient(), s.getQueueID(), "list", err)
+	})
 	return int(i), err
 }
 
+// Snapshot returns the queue size and the visited count read in one
+// MULTI/EXEC, so both are taken at the same moment, unlike separate
+// QueueSize and VisitedCount calls which can drift apart in between.
+// It needs CountVisited, and the queue and visited keys on the same client.
+func (s *Storage) Snapshot() (queueSize int, visitedCount int, err error) {
+	if !s.CountVisited {
+		return 0, 0, errors.New("visited counting is not enabled")
+	}
+	var size, count *redis.IntCmd
+	err = s.do("Snapshot", func() error {
+		c := s.queueClient()
+		if c != s.visitedClient() {
+			return errors.New("snapshot needs the queue and visited keys on the same client")
+		}
+		_, err := c.TxPipelined(s.Context, func(pipe redis.Pipeliner) error {
+			size = pipe.LLen(s.Context, s.getQueueID())
+			count = pipe.PFCount(s.Context, s.getVisitedCountID())
+			return nil
+		})
+		return err
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	return int(size.Val()), int(count.Val()), nil
+}
+
+func (s *Storage) visitedClient() RedisClient {
+	if s.VisitedClient != nil {
+		return s.VisitedClient
+	}
+	return s.client()
+}
+
+func (s *Storage) cookieClient() RedisClient {
+	if s.CookieClient != nil {
+		return s.CookieClient
+	}
+	return s.client()
+}
+
+func (s *Storage) queueClient() RedisClient {
+	if s.QueueClient != nil {
+		return s.QueueClient
+	}
+	return s.client()
+}
+
+// clients returns every distinct configured client.
+func (s *Storage) clients() []RedisClient {
+	cs := []RedisClient{s.Client}
+	for _, c := range []RedisClient{s.VisitedClient, s.CookieClient, s.QueueClient} {
+		if c == nil {
+			continue
+		}
+		seen := false
+		for _, d := range cs {
+			if c == d {
+				seen = true
+				break
+			}
+		}
+		if !seen {
+			cs = append(cs, c)
+		}
+	}
+	return cs
+}
+
+// deleteKeys deletes the given keys and all keys matching the patterns.
+func (s *Storage) deleteKeys(c RedisClient, keys []string, patterns ...string) error {
+	for _, pattern := range patterns {
+		matched, err := c.Keys(s.Context, pattern).Result()
+		if err != nil {
+			return err
+		}
+		keys = append(keys, matched...)
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	return c.Del(s.Context, keys...).Err()
+}
+
+// debugTTL logs the TTL applied to key by op if Debug is set.
+func (s *Storage) debugTTL(op, key string, ttl time.Duration) {
+	if !s.Debug {
+		return
+	}
+	if ttl <= 0 {
+		s.Logger.Printf("%s() %s without expiration", op, key)
+		return
+	}
+	s.Logger.Printf("%s() %s expires in %s", op, key, ttl)
+}
+
+// keyFamilies are the first segments after the prefix of the storage keys.
+var keyFamilies = map[string]bool{
+	"request": true, "visited": true, "crawl": true, "progress": true,
+	"cookie": true, "queue": true, "debounce": true, "attempts": true,
+	"deadletter": true, "inflight": true, "quarantine": true,
+	"clearing": true, "leader": true, "lock": true, "audit": true,
+}
+
+// ownsKey reports whether key is one of the storage keys, and not one of
+// another crawl whose prefix starts with "<prefix>:", e.g. "colly:shop".
+// A longer prefix named after a key family, e.g. "colly:queue", is not
+// told apart.
+func (s *Storage) ownsKey(key string) bool {
+	rest := strings.TrimPrefix(key, s.Prefix+":")
+	if rest == key {
+		return false
+	}
+	if i := strings.IndexByte(rest, ':'); i >= 0 {
+		rest = rest[:i]
+	}
+	return keyFamilies[rest]
+}
+
 func (s *Storage) getIDStr(ID uint64) string {
 	return fmt.Sprintf("%s:request:%d", s.Prefix, ID)
 }
 
+func (s *Storage) getVisitedCountID() string {
+	return fmt.Sprintf("%s:visited:hll", s.Prefix)
+}
+
+func (s *Storage) getVisitedCapID() string {
+	return fmt.Sprintf("%s:visited:count", s.Prefix)
+}
+
+func (s *Storage) getCrawlStartID() string {
+	return fmt.Sprintf("%s:crawl:start", s.Prefix)
+}
+
+func (s *Storage) getProgressID() string {
+	return fmt.Sprintf("%s:progress", s.Prefix)
+}
+
 func (s *Storage) getCookieID(c string) string {
-	return fmt.Sprintf("%s:cookie:%s", s.Prefix, c)
+	if s.HostNormalizer != nil {
+		c = s.HostNormalizer(c)
+	}
+	return s.getCookiePrefix() + c
+}
+
+func (s *Storage) getCookiePrefix() string {
+	return fmt.Sprintf("%s:cookie:", s.Prefix)
 }
 
 func (s *Storage) getQueueID() string {
-	return fmt.Sprintf("%s:queue", s.Prefix)
+	return s.getGenerationQueueID(int(atomic.LoadInt32(&s.generation)))
+}
+
+func (s *Storage) getGenerationQueueID(gen int) string {
+	if gen == 0 {
+		return fmt.Sprintf("%s:queue", s.Prefix)
+	}
+	return fmt.Sprintf("%s:queue:gen%d", s.Prefix, gen)
+}
+
+func (s *Storage) getDiscardedGenerationID(gen int) string {
+	return fmt.Sprintf("%s:queue:gen%d:discarded", s.Prefix, gen)
+}
+
+func (s *Storage) getGenerationID() string {
+	return fmt.Sprintf("%s:queue:generation", s.Prefix)
+}
+
+func (s *Storage) getQueueDebugID() string {
+	return fmt.Sprintf("%s:queue:debug", s.Prefix)
+}
+
+func (s *Storage) getQueueSeenID() string {
+	return fmt.Sprintf("%s:queue:seen", s.Prefix)
+}
+
+func (s *Storage) getQueueAgesID() string {
+	return fmt.Sprintf("%s:queue:ages", s.Prefix)
+}
+
+func (s *Storage) getPartitionID(p int) string {
+	return fmt.Sprintf("%s:queue:%d", s.Prefix, p)
+}
+
+func (s *Storage) getDebounceID(host string, ID uint64) string {
+	return fmt.Sprintf("%s:debounce:%s:%d", s.Prefix, host, ID)
+}
+
+func (s *Storage) getAttemptsID() string {
+	return fmt.Sprintf("%s:attempts", s.Prefix)
+}
+
+func (s *Storage) getDeadLetterID() string {
+	return fmt.Sprintf("%s:deadletter", s.Prefix)
+}
+
+func (s *Storage) getHostQueueID(host string) string {
+	return fmt.Sprintf("%s:queue:host:%s", s.Prefix, host)
+}
+
+func (s *Storage) getInFlightID(workerID string) string {
+	return fmt.Sprintf("%s:inflight:%s", s.Prefix, workerID)
+}
+
+func (s *Storage) getQuarantineID(host string) string {
+	return fmt.Sprintf("%s:quarantine:%s", s.Prefix, host)
+}
+
+func (s *Storage) getHostQuarantineID(host string) string {
+	return fmt.Sprintf("%s:quarantine:host:%s", s.Prefix, host)
+}
+
+func (s *Storage) getClearingID() string {
+	return fmt.Sprintf("%s:clearing", s.Prefix)
+}
+
+func (s *Storage) getLeaderID() string {
+	return fmt.Sprintf("%s:leader", s.Prefix)
+}
+
+func (s *Storage) getLockID(id string) string {
+	return fmt.Sprintf("%s:lock:%s", s.Prefix, id)
 }
@@ -0,0 +1,57 @@
+package collyredis
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+)
+
+// newTestStorage returns a storage on a fresh miniredis, not yet initialized.
+func newTestStorage(t testing.TB) (*Storage, *miniredis.Miniredis) {
+	m, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(m.Close)
+	client := redis.NewClient(&redis.Options{Addr: m.Addr()})
+	t.Cleanup(func() { client.Close() })
+	return &Storage{Client: client}, m
+}
+
+func TestExistingDataPolicy(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  ExistingDataPolicy
+		keys    []string
+		err     error
+		cleared bool
+	}{
+		{"resume", ResumeExistingData, []string{"colly:request:1"}, nil, false},
+		{"fail", FailOnExistingData, []string{"colly:request:1"}, ErrExistingData, false},
+		{"fail empty", FailOnExistingData, nil, nil, false},
+		{"fail audit only", FailOnExistingData, []string{"colly:audit"}, nil, false},
+		{"fail longer prefix only", FailOnExistingData, []string{"colly:shop:queue"}, nil, false},
+		{"clear", ClearExistingData, []string{"colly:request:1"}, nil, true},
+		{"clear audit only", ClearExistingData, []string{"colly:audit"}, nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, m := newTestStorage(t)
+			for _, key := range tt.keys {
+				m.Set(key, "1")
+			}
+			s.OnExistingData = tt.policy
+			err := s.Init()
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("Init() = %v, want %v", err, tt.err)
+			}
+			for _, key := range tt.keys {
+				if got := m.Exists(key); got == tt.cleared {
+					t.Errorf("%s exists = %v, want %v", key, got, !tt.cleared)
+				}
+			}
+		})
+	}
+}
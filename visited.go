@@ -0,0 +1,215 @@
+package collyredis
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// ErrVisitedCapReached is returned by Visited once MaxVisited is reached.
+var ErrVisitedCapReached = errors.New("visited cap reached")
+
+// markVisitedScript marks the requests KEYS[2..] visited if the new ones fit
+// below the cap ARGV[1] of the counter KEYS[1], all or none. A positive
+// ARGV[2] is the expiration in milliseconds. It returns 0 if the cap is hit.
+var markVisitedScript = redis.NewScript(`
+local new = 0
+for i = 2, #KEYS do
+	if redis.call('EXISTS', KEYS[i]) == 0 then
+		new = new + 1
+	end
+end
+local n = tonumber(redis.call('GET', KEYS[1]) or '0')
+if new > 0 and n + new > tonumber(ARGV[1]) then
+	return 0
+end
+for i = 2, #KEYS do
+	if tonumber(ARGV[2]) > 0 then
+		redis.call('SET', KEYS[i], '1', 'PX', ARGV[2])
+	else
+		redis.call('SET', KEYS[i], '1')
+	end
+end
+if new > 0 then
+	redis.call('INCRBY', KEYS[1], new)
+end
+return 1
+`)
+
+// VisitedTransaction marks all the requests visited in one MULTI/EXEC, so a
+// dropped connection never leaves a batch half marked. With MaxVisited the
+// batch is marked by a script instead, and fails with ErrVisitedCapReached if
+// its new requests do not fit below the cap. Note that keys of a batch may
+// live in different slots, so it does not work with redis cluster.
+func (s *Storage) VisitedTransaction(requestIDs []uint64) error {
+	if len(requestIDs) == 0 {
+		return nil
+	}
+	err := s.doWrite("VisitedTransaction", func() error {
+		if s.MaxVisited > 0 {
+			err := s.markVisitedCapped(requestIDs)
+			if err != nil || !s.CountVisited {
+				return err
+			}
+			ids := make([]interface{}, len(requestIDs))
+			for i, id := range requestIDs {
+				ids[i] = id
+			}
+			err = s.visitedClient().PFAdd(s.Context, s.getVisitedCountID(), ids...).Err()
+			return s.wrongKeyType(s.visitedClient(), s.getVisitedCountID(), "string", err)
+		}
+		_, err := s.visitedClient().TxPipelined(s.Context, func(pipe redis.Pipeliner) error {
+			for _, id := range requestIDs {
+				pipe.Set(s.Context, s.getIDStr(id), "1", s.Expires)
+				if s.CountVisited {
+					pipe.PFAdd(s.Context, s.getVisitedCountID(), id)
+				}
+			}
+			return nil
+		})
+		if err != nil && s.CountVisited {
+			return s.wrongKeyType(s.visitedClient(), s.getVisitedCountID(), "string", err)
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	for _, id := range requestIDs {
+		if s.visitedCache != nil {
+			s.visitedCache.add(id)
+		}
+		s.debugTTL("VisitedTransaction", s.getIDStr(id), s.Expires)
+		s.audit(AuditVisited, s.getIDStr(id))
+	}
+	return nil
+}
+
+// markVisitedCapped marks requests visited within the MaxVisited cap.
+func (s *Storage) markVisitedCapped(requestIDs []uint64) error {
+	keys := make([]string, 0, len(requestIDs)+1)
+	keys = append(keys, s.getVisitedCapID())
+	for _, id := range requestIDs {
+		keys = append(keys, s.getIDStr(id))
+	}
+	n, err := markVisitedScript.Run(s.Context, s.visitedClient(), keys,
+		s.MaxVisited, s.Expires.Milliseconds()).Int64()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrVisitedCapReached
+	}
+	return nil
+}
+
+// visitedCapReached reports whether MaxVisited is reached.
+func (s *Storage) visitedCapReached() (bool, error) {
+	var n int
+	err := s.do("IsVisited", func() (err error) {
+		n, err = s.visitedClient().Get(s.Context, s.getVisitedCapID()).Int()
+		if err == redis.Nil {
+			return nil
+		}
+		return err
+	})
+	return n >= s.MaxVisited, err
+}
+
+// mergeVisitedScript marks KEYS[1] visited if KEYS[1] or KEYS[2] is, with
+// the longest remaining TTL of the two, and deletes KEYS[2]. It returns 0 if
+// neither is visited.
+var mergeVisitedScript = redis.NewScript(`
+local keep = redis.call('PTTL', KEYS[1])
+local drop = redis.call('PTTL', KEYS[2])
+if keep == -2 and drop == -2 then
+	return 0
+end
+redis.call('SET', KEYS[1], '1')
+if keep == -1 or drop == -1 then
+	redis.call('PERSIST', KEYS[1])
+else
+	redis.call('PEXPIRE', KEYS[1], math.max(keep, drop))
+end
+redis.call('DEL', KEYS[2])
+return 1
+`)
+
+// MergeVisited merges the visited state of dropID into keepID, for two
+// requests found to be duplicates of each other late. keepID is marked
+// visited if either was, keeping the longest remaining TTL of the two, and
+// the dropID record is deleted. If neither is visited it is a no-op.
+func (s *Storage) MergeVisited(keepID, dropID uint64) error {
+	var merged int64
+	err := s.doWrite("MergeVisited", func() (err error) {
+		merged, err = mergeVisitedScript.Run(s.Context, s.visitedClient(),
+			[]string{s.getIDStr(keepID), s.getIDStr(dropID)}).Int64()
+		return err
+	})
+	if s.visitedCache != nil {
+		s.visitedCache.remove(dropID)
+	}
+	if err != nil {
+		return err
+	}
+	if merged == 0 {
+		return nil
+	}
+	if s.visitedCache != nil {
+		s.visitedCache.add(keepID)
+	}
+	s.audit(AuditVisited, s.getIDStr(keepID))
+	s.audit(AuditUnvisit, s.getIDStr(dropID))
+	return nil
+}
+
+// Iterator walks the IDs of the visited requests, see VisitedIterator.
+type Iterator struct {
+	s      *Storage
+	cursor uint64
+	page   []string
+	done   bool
+	err    error
+}
+
+// VisitedIterator returns an iterator over the visited request IDs.
+// It SCANs the visited keyspace lazily, one page at a time, so it can walk
+// millions of entries in constant memory. As with SCAN, keys added or
+// removed during the walk may or may not be returned, and a key may be
+// returned more than once.
+func (s *Storage) VisitedIterator() *Iterator {
+	return &Iterator{s: s}
+}
+
+// Next returns the next visited request ID, or false when the walk is
+// finished or failed; check Err in that case.
+func (it *Iterator) Next() (uint64, bool) {
+	prefix := it.s.Prefix + ":request:"
+	for {
+		for len(it.page) > 0 {
+			key := it.page[0]
+			it.page = it.page[1:]
+			id, err := strconv.ParseUint(strings.TrimPrefix(key, prefix), 10, 64)
+			if err == nil {
+				return id, true
+			}
+		}
+		if it.done || it.err != nil {
+			return 0, false
+		}
+		var next uint64
+		it.err = it.s.do("VisitedIterator", func() (err error) {
+			it.page, next, err = it.s.visitedClient().Scan(it.s.Context, it.cursor, prefix+"*", pageSize).Result()
+			return err
+		})
+		it.cursor = next
+		it.done = next == 0
+	}
+}
+
+// Err returns the error which stopped the walk, if any.
+func (it *Iterator) Err() error {
+	return it.err
+}
@@ -0,0 +1,44 @@
+package collyredis
+
+import (
+	"sync/atomic"
+)
+
+// Levels passed to OnWatermarkCrossed.
+const (
+	WatermarkHigh = "high"
+	WatermarkLow  = "low"
+)
+
+// watchesWatermarks reports whether OnWatermarkCrossed is configured.
+func (s *Storage) watchesWatermarks() bool {
+	return s.OnWatermarkCrossed != nil && s.HighWatermark > 0
+}
+
+// sizeAfterPop returns the queue size after a pop for the watermarks,
+// or -1 if they are not watched or LLEN failed.
+func (s *Storage) sizeAfterPop(key string) int64 {
+	if !s.watchesWatermarks() {
+		return -1
+	}
+	n, err := s.queueClient().LLen(s.Context, key).Result()
+	if err != nil {
+		return -1
+	}
+	return n
+}
+
+// observeWatermark calls OnWatermarkCrossed if size, the queue size after an
+// operation, rose to HighWatermark since the last low, or fell to
+// LowWatermark since the last high. A negative size is ignored. It must be
+// called outside of any lock.
+func (s *Storage) observeWatermark(size int64) {
+	if size < 0 || !s.watchesWatermarks() {
+		return
+	}
+	if size >= int64(s.HighWatermark) && atomic.CompareAndSwapInt32(&s.aboveHigh, 0, 1) {
+		s.OnWatermarkCrossed(WatermarkHigh, int(size))
+	} else if size <= int64(s.LowWatermark) && atomic.CompareAndSwapInt32(&s.aboveHigh, 1, 0) {
+		s.OnWatermarkCrossed(WatermarkLow, int(size))
+	}
+}